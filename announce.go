@@ -0,0 +1,143 @@
+package dht
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"time"
+)
+
+// AnnounceLimit limits the announces of an ip, a zero field disables
+// the limit
+type AnnounceLimit struct {
+	// Ports is the max ports an ip announces for an infohash in Window
+	Ports int
+	// Torrents is the max distinct infohashes an ip announces in Window
+	Torrents int
+	Window   time.Duration
+	// Values is the max peers of an ip in a get_peers reply
+	Values int
+	// Penalty is how long a violator is ignored, its announces are
+	// rejected and its peers are left out of replies
+	Penalty time.Duration
+}
+
+// maxAnnounced is the max infohashes an ip announces in a window if
+// Torrents is 0, since the ports of every infohash are tracked
+const maxAnnounced = 1024
+
+type announcer struct {
+	ip string
+	// ports of the infohashes announced since start of window
+	ports map[ID][]int
+	start time.Time
+	time  time.Time
+	until time.Time
+	elem  *list.Element
+}
+
+// announceGuard tracks the announces of every ip
+type announceGuard struct {
+	cap       int
+	limit     AnnounceLimit
+	ips       map[string]*announcer
+	lru       *list.List
+	penalties int
+}
+
+func newAnnounceGuard(cap int) *announceGuard {
+	return &announceGuard{
+		cap: cap,
+		limit: AnnounceLimit{
+			Ports:    8,
+			Torrents: 1024,
+			Window:   time.Hour,
+			Values:   2,
+			Penalty:  time.Hour,
+		},
+		ips: make(map[string]*announcer),
+		lru: list.New(),
+	}
+}
+
+func (g *announceGuard) Count() int {
+	return len(g.ips)
+}
+
+// Allow returns error if the announce is over limit, the ip is
+// penalized when it goes over limit
+func (g *announceGuard) Allow(ip net.IP, tor *ID, port int) error {
+	l := g.limit
+	if l.Ports <= 0 && l.Torrents <= 0 || ip.To16() == nil {
+		return nil
+	}
+	a, ok := g.ips[string(ip.To16())]
+	if !ok {
+		if len(g.ips) >= g.cap {
+			return nil
+		}
+		a = &announcer{
+			ip:    string(ip.To16()),
+			ports: make(map[ID][]int),
+		}
+		a.elem = g.lru.PushBack(a)
+		g.ips[a.ip] = a
+	}
+	now := time.Now()
+	a.time = now
+	g.lru.MoveToBack(a.elem)
+	if now.Before(a.until) {
+		return errors.New("penalized address")
+	}
+	if l.Window > 0 && now.Sub(a.start) > l.Window {
+		a.ports = make(map[ID][]int)
+		a.start = now
+	}
+	ports, ok := a.ports[*tor]
+	for _, p := range ports {
+		if p == port {
+			return nil
+		}
+	}
+	if l.Ports > 0 && len(ports) >= l.Ports {
+		return g.penalize(a, "too many ports")
+	}
+	if !ok {
+		if l.Torrents > 0 && len(a.ports) >= l.Torrents {
+			return g.penalize(a, "too many infohashes")
+		}
+		if l.Torrents <= 0 && len(a.ports) >= maxAnnounced {
+			// the ports of an untracked infohash can't be limited
+			return errors.New("too many infohashes")
+		}
+	}
+	a.ports[*tor] = append(ports, port)
+	return nil
+}
+
+func (g *announceGuard) penalize(a *announcer, reason string) error {
+	a.until = time.Now().Add(g.limit.Penalty)
+	g.penalties++
+	return errors.New(reason)
+}
+
+// Penalized returns true if ip is a violator
+func (g *announceGuard) Penalized(ip net.IP) bool {
+	if a, ok := g.ips[string(ip.To16())]; ok {
+		return time.Now().Before(a.until)
+	}
+	return false
+}
+
+// Expire remove the ips which haven't announced since tm ago
+// and aren't penalized
+func (g *announceGuard) Expire(tm time.Duration) {
+	for e := g.lru.Front(); e != nil; e = g.lru.Front() {
+		a := e.Value.(*announcer)
+		if time.Since(a.time) <= tm || time.Now().Before(a.until) {
+			return
+		}
+		g.lru.Remove(e)
+		delete(g.ips, a.ip)
+	}
+}
@@ -0,0 +1,80 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_announceGuard(t *testing.T) {
+	g := newAnnounceGuard(16)
+	g.limit = AnnounceLimit{Ports: 2, Torrents: 2, Window: time.Hour, Penalty: time.Hour}
+
+	ip := net.ParseIP("1.2.3.4")
+	id1, id2, id3 := newRandomID(), newRandomID(), newRandomID()
+	for _, port := range []int{1, 2, 1} {
+		if err := g.Allow(ip, id1, port); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Allow(ip, id2, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Allow(ip, id3, 1); err == nil || !g.Penalized(ip) {
+		t.Fatal("torrents")
+	}
+	if err := g.Allow(ip, id1, 1); err == nil {
+		t.Fatal("penalty")
+	}
+
+	ip2 := net.ParseIP("1.2.3.5")
+	g.Allow(ip2, id1, 1)
+	g.Allow(ip2, id1, 2)
+	if err := g.Allow(ip2, id1, 3); err == nil || g.penalties != 2 {
+		t.Fatal("ports")
+	}
+
+	g.Expire(-time.Second)
+	if g.Count() != 2 {
+		t.Fatal(g.Count())
+	}
+	g.ips[string(ip.To16())].until = time.Time{}
+	g.Expire(-time.Second)
+	if g.Count() != 1 {
+		t.Fatal(g.Count())
+	}
+}
+
+func Test_announceGuard_Window(t *testing.T) {
+	g := newAnnounceGuard(16)
+	g.limit = AnnounceLimit{Ports: 1, Window: time.Hour, Penalty: time.Hour}
+	ip := net.ParseIP("1.2.3.4")
+	tor := newRandomID()
+	g.Allow(ip, tor, 1)
+	for i := 0; i < maxAnnounced; i++ {
+		g.Allow(ip, newRandomID(), 1)
+	}
+	a := g.ips[string(ip.To16())]
+	if len(a.ports) != maxAnnounced || g.Allow(ip, newRandomID(), 1) == nil || g.Penalized(ip) {
+		t.Fatal(len(a.ports))
+	}
+	// the ports are forgotten with the window
+	a.start = time.Now().Add(-2 * time.Hour)
+	if err := g.Allow(ip, tor, 2); err != nil || len(a.ports) != 1 {
+		t.Fatal(err, len(a.ports))
+	}
+}
+
+func Test_announceGuard_Torrents(t *testing.T) {
+	g := newAnnounceGuard(16)
+	g.limit = AnnounceLimit{Ports: 1, Torrents: maxAnnounced + 10, Window: time.Hour, Penalty: time.Hour}
+	ip := net.ParseIP("1.2.3.4")
+	for i := 0; i < maxAnnounced+10; i++ {
+		if err := g.Allow(ip, newRandomID(), 1); err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if err := g.Allow(ip, newRandomID(), 1); err == nil || !g.Penalized(ip) {
+		t.Fatal("torrents")
+	}
+}
@@ -10,19 +10,32 @@ import (
 
 // Bucket manage node
 type Bucket struct {
-	cap   int
-	first *ID
-	time  time.Time
-	nodes *list.List
+	cap    int
+	first  *ID
+	time   time.Time
+	nodes  *list.List
+	index  map[ID]*list.Element
+	cache  *list.List
+	cached map[ID]*list.Element
+	// count of nodes of every subnet
+	subnets map[string]int
+	// accept returns false if a replacement node can't be promoted
+	accept func(n *Node) bool
+	// limits of the new nodes, nil is the default
+	limits *nodeLimits
 }
 
 // NewBucket return a bucket
 func NewBucket(first *ID, cap int) *Bucket {
 	return &Bucket{
-		cap:   cap,
-		first: first,
-		time:  time.Now(),
-		nodes: list.New(),
+		cap:     cap,
+		first:   first,
+		time:    time.Now(),
+		nodes:   list.New(),
+		index:   make(map[ID]*list.Element),
+		cache:   list.New(),
+		cached:  make(map[ID]*list.Element),
+		subnets: make(map[string]int),
 	}
 }
 
@@ -38,36 +51,66 @@ func (b *Bucket) Capacity() int {
 
 // Insert a node, move to back if exist node
 func (b *Bucket) Insert(id *ID, addr *net.UDPAddr) (n *Node) {
-	b.handle(func(e *list.Element) bool {
-		if e.Value.(*Node).id.Compare(id) == 0 {
-			n = e.Value.(*Node)
-			b.nodes.MoveToBack(e)
-			return false
+	if e, ok := b.index[*id]; ok {
+		b.nodes.MoveToBack(e)
+		return e.Value.(*Node)
+	}
+	if b.Count() < b.cap {
+		if n = b.uncache(id); n == nil {
+			n = NewNode(id, addr)
+			n.limits = b.limits
 		}
-		return true
-	})
-	if n == nil && b.Count() != b.cap {
-		n = NewNode(id, addr)
-		b.nodes.PushBack(n)
+		b.push(n)
 	}
 	return
 }
 
-// Remove a node
-func (b *Bucket) Remove(id *ID) {
-	b.handle(func(e *list.Element) bool {
-		if e.Value.(*Node).id.Compare(id) == 0 {
-			b.nodes.Remove(e)
-			return false
+// NumCached returns count of replacement nodes
+func (b *Bucket) NumCached() int {
+	return b.cache.Len()
+}
+
+// Cache a replacement node, move to back if exist node
+func (b *Bucket) Cache(id *ID, addr *net.UDPAddr) (n *Node) {
+	if e, ok := b.cached[*id]; ok {
+		b.cache.MoveToBack(e)
+		return e.Value.(*Node)
+	}
+	n = NewNode(id, addr)
+	n.limits = b.limits
+	b.recache(n)
+	return
+}
+
+// Cached returns replacement node
+func (b *Bucket) Cached(id *ID) *Node {
+	if e, ok := b.cached[*id]; ok {
+		return e.Value.(*Node)
+	}
+	return nil
+}
+
+// Replace remove a node and promote the freshest replacement node
+func (b *Bucket) Replace(id *ID) (n *Node) {
+	b.Remove(id)
+	return b.promote()
+}
+
+// Stale returns the least recently seen node
+func (b *Bucket) Stale() (node *Node) {
+	b.Map(func(n *Node) bool {
+		if node == nil || n.time.Before(node.time) {
+			node = n
 		}
 		return true
 	})
+	return
 }
 
-// Find returns node
-func (b *Bucket) Find(id *ID) (node *Node) {
+// Bad returns a bad node
+func (b *Bucket) Bad() (node *Node) {
 	b.Map(func(n *Node) bool {
-		if n.id.Compare(id) == 0 {
+		if n.State() == NodeBad {
 			node = n
 			return false
 		}
@@ -76,6 +119,74 @@ func (b *Bucket) Find(id *ID) (node *Node) {
 	return
 }
 
+// promote move the freshest good replacement node into bucket,
+// falls back to the freshest one which isn't bad
+func (b *Bucket) promote() (n *Node) {
+	if b.Count() >= b.cap {
+		return
+	}
+	var ele *list.Element
+	for e := b.cache.Back(); e != nil; e = e.Prev() {
+		if b.accept != nil && !b.accept(e.Value.(*Node)) {
+			continue
+		}
+		s := e.Value.(*Node).State()
+		if s == NodeGood {
+			ele = e
+			break
+		}
+		if s != NodeBad && ele == nil {
+			ele = e
+		}
+	}
+	if ele != nil {
+		n = b.uncache(ele.Value.(*Node).id)
+		b.push(n)
+	}
+	return
+}
+
+func (b *Bucket) push(n *Node) {
+	b.index[*n.id] = b.nodes.PushBack(n)
+	if n.addr != nil {
+		b.subnets[subnet(n.addr.IP)]++
+	}
+}
+
+// NumSubnet returns count of nodes in the subnet of ip
+func (b *Bucket) NumSubnet(ip net.IP) int {
+	return b.subnets[subnet(ip)]
+}
+
+func (b *Bucket) uncache(id *ID) *Node {
+	if e, ok := b.cached[*id]; ok {
+		delete(b.cached, *id)
+		return b.cache.Remove(e).(*Node)
+	}
+	return nil
+}
+
+// Remove a node
+func (b *Bucket) Remove(id *ID) {
+	if e, ok := b.index[*id]; ok {
+		delete(b.index, *id)
+		if n := b.nodes.Remove(e).(*Node); n.addr != nil {
+			sn := subnet(n.addr.IP)
+			if b.subnets[sn]--; b.subnets[sn] <= 0 {
+				delete(b.subnets, sn)
+			}
+		}
+	}
+}
+
+// Find returns node
+func (b *Bucket) Find(id *ID) *Node {
+	if e, ok := b.index[*id]; ok {
+		return e.Value.(*Node)
+	}
+	return nil
+}
+
 // Random returns a random node
 func (b *Bucket) Random() *Node {
 	if b.Count() == 0 {
@@ -122,13 +233,46 @@ func (b *Bucket) clean(f func(n *Node) bool) {
 	e := b.nodes.Front()
 	for e != nil {
 		next := e.Next()
-		if f(e.Value.(*Node)) {
-			b.nodes.Remove(e)
+		if n := e.Value.(*Node); f(n) {
+			b.Remove(n.id)
+		}
+		e = next
+	}
+	for b.promote() != nil {
+	}
+}
+
+// split move the nodes matched by f to another bucket,
+// the nodes beyond its capacity are kept as replacement nodes
+func (b *Bucket) split(b2 *Bucket, f func(n *Node) bool) {
+	for e := b.nodes.Front(); e != nil; {
+		next := e.Next()
+		if n := e.Value.(*Node); f(n) {
+			b.Remove(n.id)
+			if b2.Count() < b2.cap {
+				b2.push(n)
+			} else {
+				b2.recache(n)
+			}
+		}
+		e = next
+	}
+	for e := b.cache.Front(); e != nil; {
+		next := e.Next()
+		if n := e.Value.(*Node); f(n) {
+			b2.recache(b.uncache(n.id))
 		}
 		e = next
 	}
 }
 
+func (b *Bucket) recache(n *Node) {
+	if b.cap > 0 && b.cache.Len() >= b.cap {
+		b.uncache(b.cache.Front().Value.(*Node).id)
+	}
+	b.cached[*n.id] = b.cache.PushBack(n)
+}
+
 func (b *Bucket) String() string {
 	s := fmt.Sprintf("%v %d\n", b.first, b.Count())
 	b.Map(func(n *Node) bool {
@@ -18,3 +18,24 @@ func Test_Bucket(t *testing.T) {
 		return true
 	})
 }
+
+func Test_Bucket_Replace(t *testing.T) {
+	b := NewBucket(ZeroID, 2)
+	b.Insert(newRandomID(), nil)
+	n := b.Insert(newRandomID(), nil)
+	id := newRandomID()
+	if b.Insert(id, nil) != nil {
+		t.Fatal("bucket is full")
+	}
+	b.Cache(newRandomID(), nil)
+	b.Cache(id, nil)
+	if b.NumCached() != 2 {
+		t.Fatal(b.NumCached())
+	}
+	if r := b.Replace(n.id); r == nil || r.id.Compare(id) != 0 {
+		t.Fatal(r)
+	}
+	if b.Count() != 2 || b.NumCached() != 1 {
+		t.Fatal(b.Count(), b.NumCached())
+	}
+}
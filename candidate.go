@@ -0,0 +1,107 @@
+package dht
+
+import (
+	"container/list"
+	"net"
+	"time"
+)
+
+// candidate is a node learned from others, it is pinged and
+// inserted into route table only after it answers
+type candidate struct {
+	id     *ID
+	addr   *net.UDPAddr
+	time   time.Time
+	pinged time.Time
+}
+
+type candidates struct {
+	max int
+	cap int
+	// how long a ping is pending
+	timeout time.Duration
+	pending map[ID]*candidate
+	queue   *list.List
+	index   map[ID]*list.Element
+}
+
+func newCandidates(max, cap int) *candidates {
+	return &candidates{
+		max:     max,
+		cap:     cap,
+		timeout: defaultNodeLimits.defaultTimeout,
+		pending: make(map[ID]*candidate),
+		queue:   list.New(),
+		index:   make(map[ID]*list.Element),
+	}
+}
+
+func (c *candidates) Count() int {
+	return c.queue.Len()
+}
+
+func (c *candidates) NumPending() int {
+	return len(c.pending)
+}
+
+// Insert a candidate, the oldest one is dropped if queue is full
+func (c *candidates) Insert(id *ID, addr *net.UDPAddr) bool {
+	if _, ok := c.pending[*id]; ok {
+		return false
+	}
+	if _, ok := c.index[*id]; ok {
+		return false
+	}
+	if c.cap <= 0 {
+		return false
+	}
+	if c.queue.Len() >= c.cap {
+		e := c.queue.Front()
+		delete(c.index, *e.Value.(*candidate).id)
+		c.queue.Remove(e)
+	}
+	c.index[*id] = c.queue.PushBack(&candidate{
+		id:   id,
+		addr: addr,
+		time: time.Now(),
+	})
+	return true
+}
+
+// Next returns the freshest candidate to ping, or nil if there are
+// too many outstanding pings
+func (c *candidates) Next() *candidate {
+	if len(c.pending) >= c.max {
+		c.Expire(c.timeout)
+	}
+	if len(c.pending) >= c.max {
+		return nil
+	}
+	e := c.queue.Back()
+	if e == nil {
+		return nil
+	}
+	cd := c.queue.Remove(e).(*candidate)
+	delete(c.index, *cd.id)
+	cd.pinged = time.Now()
+	c.pending[*cd.id] = cd
+	return cd
+}
+
+// Remove returns the pinged candidate
+func (c *candidates) Remove(id *ID) *candidate {
+	if cd, ok := c.pending[*id]; ok {
+		delete(c.pending, *id)
+		return cd
+	}
+	return nil
+}
+
+// Expire drop the candidates which didn't answer
+func (c *candidates) Expire(tm time.Duration) {
+	for id, cd := range c.pending {
+		if time.Since(cd.pinged) > tm {
+			delete(c.pending, id)
+		}
+	}
+}
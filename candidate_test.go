@@ -0,0 +1,35 @@
+package dht
+
+import (
+	"testing"
+)
+
+func Test_candidates(t *testing.T) {
+	c := newCandidates(2, 4)
+	var ids []*ID
+	for i := 0; i < 6; i++ {
+		id := newRandomID()
+		ids = append(ids, id)
+		if !c.Insert(id, nil) {
+			t.Fatal(i)
+		}
+	}
+	if c.Insert(ids[5], nil) || c.Count() != 4 {
+		t.Fatal(c.Count())
+	}
+	if cd := c.Next(); cd == nil || cd.id != ids[5] {
+		t.Fatal(cd)
+	}
+	if cd := c.Next(); cd == nil || cd.id != ids[4] {
+		t.Fatal(cd)
+	}
+	if cd := c.Next(); cd != nil {
+		t.Fatal(cd)
+	}
+	if c.Remove(ids[5]) == nil || c.Remove(ids[5]) != nil {
+		t.Fatal(ids[5])
+	}
+	if cd := c.Next(); cd == nil || cd.id != ids[3] {
+		t.Fatal(cd)
+	}
+}
@@ -6,29 +6,74 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"sort"
 	"time"
+
+	"github.com/4396/dht/portmap"
 )
 
+// PacketConn is the connection DHT sends packets with, it is satisfied
+// by net.PacketConn, socks5.Conn and memnet.Conn. The caller reads the
+// packets and passes them to HandleMessage.
+type PacketConn interface {
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	LocalAddr() net.Addr
+}
+
 // DHT server
 type DHT struct {
-	conn     *net.UDPConn
+	conn     PacketConn
 	route    *Table
 	secret   *secret
 	searches *searches
-	storages *storages
-	tsecret  time.Time
+	store    PeerStore
+	rejects  int
+	guard    *announceGuard
+	verifies *candidates
+	cache    *nodeCache
+	trans    *transactions
+	limiter  *rateLimiter
+	pacer    *pacer
+	filter   *IPFilter
+	stats    *Stats
+	size     *sizeEstimator
+	reach    *reachability
+	mapping  *portMapping
+	// buckets scheduled by bucketTimer
+	buckets     int
+	bucketTimer *timerQueue
+	searchTimer *timerQueue
+	// allow private peer addresses
+	private bool
+	// max size of replies
+	replySize int
 }
 
-// NewDHT returns DHT
-func NewDHT(id *ID, conn *net.UDPConn, ksize int) *DHT {
-	return &DHT{
+// NewDHT returns DHT, conn is an udp connection or a transport like
+// socks5.Conn or memnet.Conn, caps are the bucket capacities near the
+// root of route table, see NewTable
+func NewDHT(id *ID, conn PacketConn, ksize int, caps ...int) *DHT {
+	d := &DHT{
 		conn:     conn,
-		route:    NewTable(id, ksize),
+		route:    NewTable(id, ksize, caps...),
 		secret:   newSecret(),
 		searches: newSearches(),
-		storages: newStorages(),
-		tsecret:  time.Now(),
+		store:    NewMemoryStore(),
+		guard:    newAnnounceGuard(65536),
+		verifies: newCandidates(16, 1024),
+		cache:    newNodeCache(4096, 30*time.Minute),
+		trans:    newTransactions(65536),
+		limiter:  newRateLimiter(65536),
+		pacer:    newPacer(),
+		size:     newSizeEstimator(0.05),
+		reach:    newReachability(65536),
+
+		bucketTimer: newTimerQueue(),
+		searchTimer: newTimerQueue(),
+		replySize:   DefaultReplySize,
 	}
+	d.cache.limits = d.route.limits
+	return d
 }
 
 // ID returns dht id
@@ -37,14 +82,16 @@ func (d *DHT) ID() *ID {
 }
 
 // Conn returns dht connection
-func (d *DHT) Conn() *net.UDPConn {
+func (d *DHT) Conn() PacketConn {
 	return d.conn
 }
 
 // Addr returns dht address
 func (d *DHT) Addr() *net.UDPAddr {
 	if conn := d.conn; conn != nil {
-		return conn.LocalAddr().(*net.UDPAddr)
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+			return addr
+		}
 	}
 	return nil
 }
@@ -54,79 +101,349 @@ func (d *DHT) Route() *Table {
 	return d.route
 }
 
+// SetVerifyLimit set the max outstanding pings sent to nodes learned
+// from others and the max nodes waiting to be pinged
+func (d *DHT) SetVerifyLimit(pending, queued int) {
+	d.verifies.max = pending
+	d.verifies.cap = queued
+}
+
+// SetRateLimit set the inbound limits of a query method
+func (d *DHT) SetRateLimit(meth string, l RateLimit) {
+	d.limiter.Set(meth, l)
+}
+
+// Shed returns count of the over limit queries of every method
+func (d *DHT) Shed() map[string]int {
+	return d.limiter.Shed()
+}
+
+// SetSendRate set the outbound packets and bytes per second, 0 is
+// unlimited, and the max packets queued over budget. Replies go ahead
+// of queries and maintenance traffic, call Flush periodically to send
+// the queued packets.
+func (d *DHT) SetSendRate(pps, bps, queue int) {
+	d.pacer.Set(pps, bps, queue)
+}
+
+// SendStats returns count of the sent, deferred and dropped packets
+func (d *DHT) SendStats() SendStats {
+	return d.pacer.stats
+}
+
+// Flush send the queued packets which fit the budget
+func (d *DHT) Flush() int {
+	return d.pacer.Flush()
+}
+
+// SetTokenRotation set how often the token secret rotates and how
+// many previous secrets are still accepted, a negative keep is 0
+func (d *DHT) SetTokenRotation(interval time.Duration, keep int) {
+	d.secret.Set(interval, keep)
+}
+
+// SetIPFilter set the filter which keeps blocked addresses out of
+// route table, peer store, searches and replies, nil disables it
+func (d *DHT) SetIPFilter(f *IPFilter) {
+	d.filter = f
+}
+
+// SetNodeLimits set how long a node stays good without activity and
+// how many queries in a row it may fail before it goes bad, the
+// defaults are 15 minutes and 3
+func (d *DHT) SetNodeLimits(good time.Duration, fails int) {
+	d.route.SetNodeLimits(good, fails)
+}
+
+// SetQueryTimeout set the query timeout of a node without rtt
+// estimate, and the bounds of the timeout derived from rtt, the
+// defaults are 4, 0.5 and 10 seconds
+func (d *DHT) SetQueryTimeout(timeout, min, max time.Duration) {
+	l := d.route.limits
+	l.defaultTimeout, l.minTimeout, l.maxTimeout = timeout, min, max
+	d.verifies.timeout = timeout
+}
+
+// SetNodeCache set the size of node cache used to seed lookups
+// and how long a node stays in it without answering
+func (d *DHT) SetNodeCache(size int, age time.Duration) {
+	d.cache.cap = size
+	d.cache.age = age
+	for d.cache.Count() > size {
+		d.cache.evict()
+	}
+}
+
+// SetPeerStore set the store of announced peers, MemoryStore is
+// the default
+func (d *DHT) SetPeerStore(s PeerStore) {
+	d.store = s
+}
+
+// PeerStore returns the store of announced peers
+func (d *DHT) PeerStore() PeerStore {
+	return d.store
+}
+
+// SetStoreLimits set the limits of announced peers store if the
+// store supports limits
+func (d *DHT) SetStoreLimits(l StoreLimits) {
+	if s, ok := d.store.(interface {
+		SetLimits(StoreLimits)
+	}); ok {
+		s.SetLimits(l)
+	}
+}
+
+// StoreStats returns size and eviction counts of announced peers store
+func (d *DHT) StoreStats() (stats StoreStats) {
+	if s, ok := d.store.(interface {
+		Stats() StoreStats
+	}); ok {
+		stats = s.Stats()
+	} else {
+		stats.Torrents = d.store.Count()
+	}
+	stats.Rejects += d.rejects
+	stats.Penalties = d.guard.penalties
+	return
+}
+
+// SetAllowPrivatePeers allow the peers of private addresses to be
+// stored and found, e.g. in LAN, see ValidatePeer
+func (d *DHT) SetAllowPrivatePeers(allow bool) {
+	d.private = allow
+}
+
+// SetReplySize set the max size of find_node and get_peers replies,
+// values and nodes which don't fit are left out
+func (d *DHT) SetReplySize(size int) {
+	d.replySize = size
+}
+
+// SetStats set the statistics of get_peers queries and announces,
+// nil disables it
+func (d *DHT) SetStats(s *Stats) {
+	d.stats = s
+}
+
+// Reachability returns whether other nodes can reach DHT
+func (d *DHT) Reachability() Reachability {
+	return d.reach.state
+}
+
+// SetReachabilityCallback set the function called when reachability
+// changes. A firewalled DHT sends read only queries, see BEP 43, so
+// that other nodes don't insert it into their route tables, except in
+// the probes which let it find out it is reachable again.
+func (d *DHT) SetReachabilityCallback(f func(Reachability)) {
+	d.reach.notify = f
+}
+
+// SetReachLimits set how long a contacted node may query us through
+// NAT, which is also how long DHT stays reachable after a query from
+// another node, and the min replies in it without any such query for
+// DHT to be firewalled, the defaults are 15 minutes and 20
+func (d *DHT) SetReachLimits(timeout time.Duration, replies int) {
+	d.reach.timeout = timeout
+	d.reach.minReplies = replies
+}
+
+// SetReachProbe set how long a firewalled DHT sends normal queries of
+// every interval to find out if it is reachable, 0 interval disables
+// it, the defaults are 1 of 10 minutes
+func (d *DHT) SetReachProbe(interval, window time.Duration) {
+	d.reach.probeInterval = interval
+	d.reach.probeWindow = window
+}
+
+// MapPort map the udp port of DHT on gateway with m, see
+// portmap.Discover, the mapping is renewed until Close
+func (d *DHT) MapPort(m portmap.Mapper, lifetime time.Duration) error {
+	addr := d.Addr()
+	if addr == nil {
+		return errors.New("no connection")
+	}
+	if d.mapping != nil {
+		d.mapping.Close()
+		d.mapping = nil
+	}
+	p, err := newPortMapping(m, addr.Port, lifetime)
+	if err != nil {
+		return err
+	}
+	d.mapping = p
+	return nil
+}
+
+// ExternalAddr returns the address other nodes reach DHT at, nil if
+// it is unknown or the mapping expired. The nodes at this address are
+// not inserted into route table or searches.
+func (d *DHT) ExternalAddr() *net.UDPAddr {
+	if d.mapping != nil {
+		return d.mapping.Addr()
+	}
+	return nil
+}
+
+// Close remove the port mapping, the connection is left to caller
+func (d *DHT) Close() (err error) {
+	if d.mapping != nil {
+		err = d.mapping.Close()
+		d.mapping = nil
+	}
+	return
+}
+
+// SetAnnounceLimit set the per ip limits of announces
+func (d *DHT) SetAnnounceLimit(l AnnounceLimit) {
+	d.guard.limit = l
+}
+
+// cleanNodes refresh or clean the buckets which are due
 func (d *DHT) cleanNodes(tm time.Duration) {
-	d.route.Map(func(b *Bucket) bool {
-		if time.Since(b.time) > tm {
-			if n := b.Random(); n != nil {
-				d.FindNode(n.ID())
+	now := time.Now()
+	for ; d.buckets < len(d.route.buckets); d.buckets++ {
+		d.bucketTimer.Schedule(d.route.buckets[d.buckets], now)
+	}
+	for key, ok := d.bucketTimer.Next(now); ok; key, ok = d.bucketTimer.Next(now) {
+		b := key.(*Bucket)
+		d.cleanBucket(b, tm)
+		d.bucketTimer.Schedule(b, d.nextTime(d.nextClean(b, tm), now))
+	}
+}
+
+func (d *DHT) cleanBucket(b *Bucket, tm time.Duration) {
+	if time.Since(b.time) > tm {
+		if n := b.Random(); n != nil {
+			d.findNode(n.ID(), SendMaintenance)
+		}
+		b.Update()
+		return
+	}
+	b.clean(func(n *Node) bool {
+		if n.pingTimedOut() {
+			n.Fail()
+		}
+		switch n.State() {
+		case NodeBad:
+			return true
+		case NodeQuestionable:
+			if n.pinged == 0 {
+				d.ping(n.addr)
+				n.pingSent()
 			}
-		} else {
-			b.clean(func(n *Node) bool {
-				if n.pinged > 0 {
-					return true
-				}
-				if time.Since(n.time) > tm {
-					d.ping(n.addr)
-					n.pinged++
-				}
-				return false
-			})
 		}
-		return true
+		return false
 	})
 }
 
-func (d *DHT) cleanPeers(tm time.Duration) {
-	var ss []*ID
-	d.storages.Map(func(st *storage) bool {
-		var peers [][]byte
-		st.Map(func(p []byte, t time.Time) bool {
-			if time.Since(t) > tm {
-				peers = append(peers, p)
-			}
-			return true
-		})
-		if len(peers) == st.Count() {
-			ss = append(ss, st.ID())
-		} else {
-			for _, p := range peers {
-				st.Remove(p)
-			}
+// nextClean returns when a bucket goes stale, a node turns
+// questionable or a pinged node times out
+func (d *DHT) nextClean(b *Bucket, tm time.Duration) time.Time {
+	next := b.time.Add(tm)
+	b.Map(func(n *Node) bool {
+		t := n.goodUntil()
+		if n.pinged > 0 {
+			t = n.ping.Add(n.Timeout())
+		}
+		if t.Before(next) {
+			next = t
 		}
 		return true
 	})
-	for _, s := range ss {
-		d.storages.Remove(s)
+	return next
+}
+
+// nextTime returns t, or a bit later than now if t is due
+func (d *DHT) nextTime(t, now time.Time) time.Time {
+	if min := now.Add(d.route.limits.minTimeout); t.Before(min) {
+		return min
 	}
+	return t
+}
+
+func (d *DHT) cleanPeers(tm time.Duration) {
+	d.store.Expire(tm)
+	d.guard.Expire(tm)
 }
 
+// cleanSearches finish the searches which are due
 func (d *DHT) cleanSearches(tm time.Duration) {
-	var tids []int16
-	d.searches.Map(func(tid int16, sr *search) bool {
-		if sr.Done(tm) {
-			sr.Notify(sr.tor, nil)
-			tids = append(tids, tid)
+	now := time.Now()
+	for key, ok := d.searchTimer.Next(now); ok; key, ok = d.searchTimer.Next(now) {
+		tid := key.(int16)
+		sr := d.searches.Get(tid)
+		if sr == nil {
+			continue
 		}
-		return true
-	})
-	for _, tid := range tids {
-		d.searches.Remove(tid)
+		if !sr.Done(tm) {
+			d.searchTimer.Schedule(tid, d.nextTime(sr.Deadline(tm), now))
+			continue
+		}
+		sr.Map(func(sn *node) bool {
+			if sn.Expired() {
+				if n := d.find(sn.id); n != nil {
+					n.Fail()
+				}
+				d.cache.Fail(sn.id)
+			}
+			return true
+		})
+		d.finishSearch(tid, sr)
 	}
 }
 
-// DoTimer update secret, clean nodes and peers
-func (d *DHT) DoTimer(secret, node, peer, search time.Duration) {
-	if time.Since(d.tsecret) >= secret {
-		d.tsecret = time.Now()
-		d.secret.Update()
+// finishSearch notify the end of a search, its closest nodes are
+// sampled to estimate network size
+func (d *DHT) finishSearch(tid int16, sr *search) {
+	var ids []*ID
+	for _, n := range sr.Closest(d.route.ksize) {
+		if len(ids) == d.route.ksize {
+			break
+		}
+		ids = append(ids, n.id)
 	}
+	d.size.Add(sr.tor, ids)
+	sr.Notify(sr.tor, nil)
+	d.searches.Remove(tid)
+	d.searchTimer.Remove(tid)
+}
+
+// NetworkSizeEstimate returns estimated count of nodes of DHT, it is
+// fitted from the closest nodes of completed searches, 0 if unknown
+func (d *DHT) NetworkSizeEstimate() int {
+	return d.size.Estimate()
+}
+
+// DoTimer clean nodes and peers,
+// search is the max duration of a search
+func (d *DHT) DoTimer(node, peer, search time.Duration) {
+	d.Flush()
 	d.cleanNodes(node)
 	d.cleanPeers(peer)
 	d.cleanSearches(search)
+	d.verifies.Expire(d.verifies.timeout)
+	d.pingCandidates()
+	d.cache.Expire()
+	d.trans.Expire(d.route.limits.maxTimeout)
+	d.limiter.Expire()
+	if d.mapping != nil && d.mapping.Changed() {
+		// the traffic seen at old address tells nothing of new one
+		d.reach.Reset()
+	}
+	d.reach.Expire()
+	if d.stats != nil {
+		d.stats.Expire()
+	}
 }
 
 // HandleMessage handle udp packet
 func (d *DHT) HandleMessage(addr *net.UDPAddr, data []byte, t *Tracker) (err error) {
+	d.Flush()
+	if d.blocked(addr.IP) {
+		return errors.New("blocked address")
+	}
 	var msg kadMessage
 	err = decodeMessage(data, &msg)
 	if err != nil {
@@ -134,8 +451,10 @@ func (d *DHT) HandleMessage(addr *net.UDPAddr, data []byte, t *Tracker) (err err
 	}
 	switch msg.Y {
 	case "q":
-		err = d.handleQueryMessage(addr, msg.T, msg.Q, &msg.A, t.q)
+		d.reach.Query(addr.IP)
+		err = d.handleQueryMessage(addr, msg.T, msg.Q, &msg.A, msg.RO == 1, t.q)
 	case "r":
+		d.reach.Reply()
 		err = d.handleReplyMessage(addr, msg.T, &msg.R, t.r)
 	case "e":
 		err = d.handleErrorMessage(addr, msg.E, t.e)
@@ -143,12 +462,26 @@ func (d *DHT) HandleMessage(addr *net.UDPAddr, data []byte, t *Tracker) (err err
 	return
 }
 
-func (d *DHT) handleQueryMessage(addr *net.UDPAddr, tid []byte, meth string, args *kadArguments, t QueryTracker) (err error) {
+// handleQueryMessage answers a query, a read only sender isn't
+// inserted into route table
+func (d *DHT) handleQueryMessage(addr *net.UDPAddr, tid []byte, meth string, args *kadArguments, ro bool, t QueryTracker) (err error) {
 	id, err := NewID(args.ID)
 	if err != nil {
 		return
 	}
-	d.insertOrUpdate(id, addr)
+	if ok, reply := d.limiter.Allow(meth, addr.IP); !ok {
+		if reply {
+			d.replyError(tid, addr, 202, "Server Error")
+		}
+		return
+	}
+	if ro {
+		if n := d.find(id); n != nil && sameIP(n.addr, addr) {
+			n.Queried()
+		}
+	} else if n, _ := d.insertOrUpdate(id, addr); n != nil {
+		n.Queried()
+	}
 
 	switch meth {
 	case "ping":
@@ -168,6 +501,9 @@ func (d *DHT) handleQueryMessage(addr *net.UDPAddr, tid []byte, meth string, arg
 		tor, err := NewID(args.InfoHash)
 		if err == nil {
 			d.replyGetPeers(addr, tid, tor)
+			if d.stats != nil {
+				d.stats.Query(tor, addr.IP)
+			}
 			if t != nil {
 				t.GetPeers(id, tor)
 			}
@@ -190,7 +526,19 @@ func (d *DHT) handleReplyMessage(addr *net.UDPAddr, tid []byte, resp *kadRespons
 	if err != nil {
 		return
 	}
-	d.insertOrUpdate(id, addr)
+	// only the sender of a reply to our query is admitted
+	if rtt, ok := d.trans.Remove(addr, tid); ok {
+		if n, _ := d.insertOrUpdate(id, addr); n != nil {
+			n.Replied()
+			n.Sample(rtt)
+		}
+		if n := d.cache.Insert(id, addr); n != nil {
+			n.Sample(rtt)
+		}
+	}
+	if d.verifies.Remove(id) != nil {
+		d.pingCandidates()
+	}
 
 	q, no := decodeTID(tid)
 	switch q {
@@ -232,7 +580,7 @@ func (d *DHT) handleErrorMessage(addr *net.UDPAddr, err []interface{}, t ErrorTr
 
 func (d *DHT) handleFindNode(nodes []byte) {
 	for id, addr := range decodeCompactNode(nodes) {
-		d.insertOrUpdate(id, addr)
+		d.verify(id, addr)
 	}
 }
 
@@ -241,14 +589,20 @@ func (d *DHT) handleGetPeers(tid int16, id *ID, values [][]byte, nodes []byte) {
 	if sr == nil {
 		return
 	}
-	if sn := sr.Get(id); sn != nil {
-		sn.acked = true
-	} else {
+	sn := sr.Get(id)
+	if sn == nil {
 		return
 	}
+	sn.acked = true
 
 	if len(values) > 0 {
 		for _, peer := range values {
+			if ValidatePeer(peer, d.private) != nil {
+				continue
+			}
+			if ip, _ := ResolvePeer(peer); d.blocked(net.ParseIP(ip)) {
+				continue
+			}
 			// unreliable peer
 			//d.storePeer(sr.tor, peer)
 			sr.Notify(sr.tor, peer)
@@ -256,12 +610,25 @@ func (d *DHT) handleGetPeers(tid int16, id *ID, values [][]byte, nodes []byte) {
 	} else if len(nodes) > 0 {
 		var addrs []*net.UDPAddr
 		for id, addr := range decodeCompactNode(nodes) {
-			d.insertOrUpdate(id, addr)
-			if sr.Count() < d.route.ksize*2 {
-				sn := sr.Insert(id, addr)
-				if sn.acked == false {
+			if d.blocked(addr.IP) || d.self(addr) {
+				continue
+			}
+			n := sr.Get(id)
+			if n != nil && n.path != sn.path {
+				// claimed by another path
+				continue
+			}
+			// a full path still takes the nodes which may improve its
+			// k closest, up to a hard limit
+			count := sr.PathCount(sn.path)
+			if n != nil || count < d.route.ksize*2 ||
+				count < d.route.ksize*8 && sr.Closer(id, sn.path, d.route.ksize) {
+				n = sr.Insert(id, addr, d.timeout(id), sn.path)
+				if n.acked == false {
 					addrs = append(addrs, addr)
 				}
+			} else {
+				d.verify(id, addr)
 			}
 		}
 		if addrs != nil {
@@ -270,8 +637,7 @@ func (d *DHT) handleGetPeers(tid int16, id *ID, values [][]byte, nodes []byte) {
 	}
 
 	if sr.Done(0) {
-		sr.Notify(sr.tor, nil)
-		d.searches.Remove(tid)
+		d.finishSearch(tid, sr)
 	}
 }
 
@@ -280,14 +646,17 @@ func (d *DHT) handleAnnouncePeer() {
 
 // Ping a address
 func (d *DHT) Ping(addr *net.UDPAddr) error {
-	return d.ping(addr)
+	data := map[string]interface{}{
+		"id": d.ID().Bytes(),
+	}
+	return d.queryMessage("ping", 0, addr, data, SendQuery)
 }
 
 func (d *DHT) ping(addr *net.UDPAddr) error {
 	data := map[string]interface{}{
 		"id": d.ID().Bytes(),
 	}
-	return d.queryMessage("ping", 0, addr, data)
+	return d.queryMessage("ping", 0, addr, data, SendMaintenance)
 }
 
 // FindNodeFromAddr find node from address
@@ -296,7 +665,7 @@ func (d *DHT) FindNodeFromAddr(id *ID, addr *net.UDPAddr) error {
 		"id":     d.ID().Bytes(),
 		"target": id.Bytes(),
 	}
-	return d.queryMessage("find_node", 0, addr, data)
+	return d.queryMessage("find_node", 0, addr, data, SendQuery)
 }
 
 // FindNodeFromAddrs find node from some address
@@ -305,23 +674,39 @@ func (d *DHT) FindNodeFromAddrs(id *ID, addrs []*net.UDPAddr) (int, error) {
 		"id":     d.ID().Bytes(),
 		"target": id.Bytes(),
 	}
-	return d.batchQueryMessage("find_node", 0, addrs, data)
+	return d.batchQueryMessage("find_node", 0, addrs, data, SendQuery)
 }
 
 // FindNode find node
-func (d *DHT) FindNode(id *ID) (err error) {
-	_, err = d.FindNodeFromAddrs(id, d.lookup(id))
+func (d *DHT) FindNode(id *ID) error {
+	return d.findNode(id, SendQuery)
+}
+
+func (d *DHT) findNode(id *ID, prio SendPriority) (err error) {
+	data := map[string]interface{}{
+		"id":     d.ID().Bytes(),
+		"target": id.Bytes(),
+	}
+	_, err = d.batchQueryMessage("find_node", 0, d.lookup(id), data, prio)
 	return
 }
 
 // Search info hash
 func (d *DHT) Search(tor *ID, cb CallBack) (tid int16, err error) {
+	return d.SearchPaths(tor, 1, cb)
+}
+
+// SearchPaths search info hash along disjoint paths which never share
+// nodes, so a poisoned node can steer only one of them. The initial
+// nodes are split into the paths. The union of the closest nodes of
+// every path is returned by SearchClosest.
+func (d *DHT) SearchPaths(tor *ID, paths int, cb CallBack) (tid int16, err error) {
 	tid, _ = d.searches.Find(tor)
 	if tid != -1 {
 		err = errors.New("")
 		return
 	}
-	tid, sr := d.searches.Insert(tor, cb)
+	tid, sr := d.searches.Insert(tor, cb, paths)
 	if tid == -1 {
 		err = errors.New("")
 		return
@@ -332,14 +717,28 @@ func (d *DHT) Search(tor *ID, cb CallBack) (tid int16, err error) {
 	}
 
 	var addrs []*net.UDPAddr
-	for _, node := range d.route.Lookup(tor) {
-		sr.Insert(node.id, node.addr)
+	for i, node := range d.allowed(d.closest(tor)) {
+		sr.Insert(node.id, node.addr, node.Timeout(), i%sr.NumPaths())
 		addrs = append(addrs, node.addr)
 	}
 	if n, _ := d.search(tid, tor, addrs); n == 0 {
 		d.searches.Remove(tid)
 		err = errors.New("")
 		tid = -1
+		return
+	}
+	d.searchTimer.Schedule(tid, time.Now())
+	return
+}
+
+// SearchClosest returns the union of the K closest nodes answered on
+// every path of a search, it is valid until the search is done, e.g.
+// in the last call of CallBack with a nil peer
+func (d *DHT) SearchClosest(tid int16) (nodes []*Node) {
+	if sr := d.searches.Get(tid); sr != nil {
+		for _, n := range sr.Closest(d.route.ksize) {
+			nodes = append(nodes, NewNode(n.id, n.addr))
+		}
 	}
 	return
 }
@@ -349,12 +748,12 @@ func (d *DHT) search(tid int16, tor *ID, addrs []*net.UDPAddr) (int, error) {
 		"id":        d.ID().Bytes(),
 		"info_hash": tor.Bytes(),
 	}
-	return d.batchQueryMessage("get_peers", tid, addrs, data)
+	return d.batchQueryMessage("get_peers", tid, addrs, data, SendQuery)
 }
 
 // GetPeers returns all peers
 func (d *DHT) GetPeers(tor *ID) [][]byte {
-	return d.getPeers(tor, 0)
+	return d.getPeers(tor, 0, 0)
 }
 
 func (d *DHT) announcePeer(tor *ID, port int, addr *net.UDPAddr, token []byte) error {
@@ -364,7 +763,7 @@ func (d *DHT) announcePeer(tor *ID, port int, addr *net.UDPAddr, token []byte) e
 		"port":      port,
 		"token":     token,
 	}
-	return d.queryMessage("announce_peer", 0, addr, data)
+	return d.queryMessage("announce_peer", 0, addr, data, SendQuery)
 }
 
 func (d *DHT) replyPing(addr *net.UDPAddr, tid []byte) {
@@ -375,11 +774,11 @@ func (d *DHT) replyPing(addr *net.UDPAddr, tid []byte) {
 }
 
 func (d *DHT) replyFindNode(addr *net.UDPAddr, tid []byte, target *ID) {
-	if nodes := d.route.Lookup(target); nodes != nil {
+	if nodes := d.allowed(d.route.Lookup(target)); nodes != nil {
 		data := map[string]interface{}{
-			"id":    d.ID().Bytes(),
-			"nodes": encodeCompactNodes(nodes),
+			"id": d.ID().Bytes(),
 		}
+		newReplyBuilder(d.replySize, tid, data).Nodes(encodeCompactNodes(nodes))
 		d.replyMessage(tid, addr, data)
 	}
 }
@@ -389,10 +788,13 @@ func (d *DHT) replyGetPeers(addr *net.UDPAddr, tid []byte, tor *ID) {
 		"id":    d.ID().Bytes(),
 		"token": d.createToken(addr),
 	}
-	if peers := d.getPeers(tor, d.route.ksize); peers != nil {
-		data["values"] = peers
-	} else if nodes := d.route.Lookup(tor); nodes != nil {
-		data["nodes"] = encodeCompactNodes(nodes)
+	b := newReplyBuilder(d.replySize, tid, data)
+	// twice the peers a reply holds, a compact peer takes 8 bytes
+	peers := d.getPeers(tor, d.guard.limit.Values, 2*d.replySize/8)
+	shufflePeers(peers)
+	// other nodes are returned as well if peers are scarce
+	if b.Values(peers) < d.route.ksize {
+		b.Nodes(encodeCompactNodes(d.allowed(d.route.Lookup(tor))))
 	}
 	d.replyMessage(tid, addr, data)
 }
@@ -407,20 +809,22 @@ func (d *DHT) replyAnnouncePeer(addr *net.UDPAddr, tid []byte, token []byte, tor
 	}
 	d.replyMessage(tid, addr, data)
 
+	if d.stats != nil {
+		d.stats.Announce(tor, addr.IP)
+	}
 	err := d.storePeer(tor, peer)
 	if err != nil {
 		return
 	}
 }
 
+// createToken binds token to the ip only, see BEP 5
 func (d *DHT) createToken(addr *net.UDPAddr) []byte {
-	b := []byte(addr.String())
-	return d.secret.Create(b)
+	return d.secret.Create(addr.IP.To16())
 }
 
 func (d *DHT) matchToken(addr *net.UDPAddr, token []byte) bool {
-	b := []byte(addr.String())
-	return d.secret.Match(b, token)
+	return d.secret.Match(addr.IP.To16(), token)
 }
 
 func (d *DHT) find(id *ID) (n *Node) {
@@ -431,41 +835,173 @@ func (d *DHT) find(id *ID) (n *Node) {
 }
 
 func (d *DHT) insertOrUpdate(id *ID, addr *net.UDPAddr) (n *Node, err error) {
+	if d.blocked(addr.IP) {
+		err = errors.New("blocked address")
+		return
+	}
+	if d.self(addr) {
+		err = errors.New("own address")
+		return
+	}
 	if b := d.route.Find(id); b != nil {
-		if n = b.Find(id); n != nil {
-			n.Update()
-		} else {
-			n, err = d.route.Insert(id, addr)
+		if n = b.Find(id); n != nil && !sameIP(n.addr, addr) {
+			return nil, errors.New("id used by another address")
+		}
+		if n == nil {
+			if n, err = d.route.Insert(id, addr); err == errBucketFull {
+				n = d.replaceStale(d.route.Find(id), id, addr)
+			}
 		}
 		b.Update()
 	}
 	return
 }
 
+// replaceStale replace a bad node of a full bucket with the cached node,
+// or ping the least recently seen node if it is questionable, returns
+// the node of id at addr
+func (d *DHT) replaceStale(b *Bucket, id *ID, addr *net.UDPAddr) (n *Node) {
+	if b == nil {
+		return nil
+	}
+	if bad := b.Bad(); bad != nil {
+		b.Replace(bad.id)
+		n = b.Find(id)
+	} else if stale := b.Stale(); stale != nil && stale.pinged == 0 && stale.State() == NodeQuestionable {
+		d.ping(stale.addr)
+		stale.pingSent()
+	}
+	if n == nil {
+		n = b.Cached(id)
+	}
+	if n != nil && !sameIP(n.addr, addr) {
+		return nil
+	}
+	return
+}
+
+// verify ping a node learned from others, it is inserted into
+// route table only after it answers
+func (d *DHT) verify(id *ID, addr *net.UDPAddr) {
+	if id.Compare(d.ID()) == 0 || d.find(id) != nil || d.blocked(addr.IP) || d.self(addr) {
+		return
+	}
+	if d.verifies.Insert(id, addr) {
+		d.pingCandidates()
+	}
+}
+
+func (d *DHT) pingCandidates() {
+	for c := d.verifies.Next(); c != nil; c = d.verifies.Next() {
+		d.ping(c.addr)
+	}
+}
+
 func (d *DHT) storePeer(tor *ID, peer []byte) error {
-	if d.storages.Count() > 102400 {
-		return errors.New("102400")
+	if err := ValidatePeer(peer, d.private); err != nil {
+		d.rejects++
+		return err
 	}
-	s := d.storages.Get(tor)
-	if s.Count() > 1024 {
-		return errors.New("1024")
+	ip, port := ResolvePeer(peer)
+	if d.blocked(net.ParseIP(ip)) {
+		d.rejects++
+		return errors.New("blocked address")
 	}
-	s.Insert(peer)
-	return nil
+	if err := d.guard.Allow(net.ParseIP(ip), tor, port); err != nil {
+		d.rejects++
+		return err
+	}
+	return d.store.Insert(tor, peer)
 }
 
-func (d *DHT) getPeers(tor *ID, max int) (ps [][]byte) {
-	if s := d.storages.Find(tor); s != nil {
-		s.Map(func(peer []byte, time time.Time) bool {
-			ps = append(ps, peer)
-			return max <= 0 || len(ps) < max
-		})
+// getPeers returns the peers most recently announced first, the peers
+// of blocked or penalized ips are left out, and at most perIP peers of
+// an ip are returned if perIP > 0. Only the max most recent peers are
+// looked up if max > 0.
+func (d *DHT) getPeers(tor *ID, perIP, max int) (ps [][]byte) {
+	ips := make(map[string]int)
+	for _, peer := range d.store.Lookup(tor, max) {
+		s, _ := ResolvePeer(peer)
+		ip := net.ParseIP(s)
+		if d.blocked(ip) || d.guard.Penalized(ip) {
+			continue
+		}
+		if perIP > 0 && ips[s] >= perIP {
+			continue
+		}
+		ips[s]++
+		ps = append(ps, peer)
 	}
 	return
 }
 
+// closest returns the K closest nodes of route table and node cache,
+// the faster nodes are preferred at similar distance
+func (d *DHT) closest(id *ID) []*Node {
+	k := d.route.ksize
+	cn := newClosestNodes(id, 2*k)
+	seen := make(map[ID]bool)
+	for _, n := range d.route.lookup(id, 2*k) {
+		seen[*n.id] = true
+		cn.Push(n)
+	}
+	for _, n := range d.cache.Closest(id, 2*k) {
+		if !seen[*n.id] {
+			cn.Push(n)
+		}
+	}
+	nodes := cn.Sorted()
+	sort.SliceStable(nodes, func(i, j int) bool {
+		p1, p2 := id.PrefixLen(nodes[i].id), id.PrefixLen(nodes[j].id)
+		if p1 != p2 {
+			return p1 > p2
+		}
+		return nodes[i].Timeout() < nodes[j].Timeout()
+	})
+	if len(nodes) > k {
+		nodes = nodes[:k]
+	}
+	return nodes
+}
+
+// timeout returns query timeout of a node
+func (d *DHT) timeout(id *ID) time.Duration {
+	if n := d.find(id); n != nil {
+		return n.Timeout()
+	}
+	if n := d.cache.Find(id); n != nil {
+		return n.Timeout()
+	}
+	return d.route.limits.defaultTimeout
+}
+
+func (d *DHT) blocked(ip net.IP) bool {
+	return d.filter != nil && d.filter.Blocked(ip)
+}
+
+// self returns true if addr is the external address of DHT, which
+// other nodes may hand out for another id
+func (d *DHT) self(addr *net.UDPAddr) bool {
+	ext := d.ExternalAddr()
+	return ext != nil && ext.Port == addr.Port && ext.IP.Equal(addr.IP)
+}
+
+// allowed returns the nodes not blocked by filter
+func (d *DHT) allowed(nodes []*Node) []*Node {
+	if d.filter == nil {
+		return nodes
+	}
+	var ns []*Node
+	for _, n := range nodes {
+		if !d.blocked(n.addr.IP) {
+			ns = append(ns, n)
+		}
+	}
+	return ns
+}
+
 func (d *DHT) lookup(id *ID) (addrs []*net.UDPAddr) {
-	if nodes := d.route.Lookup(id); len(nodes) > 0 {
+	if nodes := d.allowed(d.closest(id)); len(nodes) > 0 {
 		addrs = make([]*net.UDPAddr, len(nodes))
 		for i, node := range nodes {
 			addrs[i] = node.Addr()
@@ -474,9 +1010,24 @@ func (d *DHT) lookup(id *ID) (addrs []*net.UDPAddr) {
 	return
 }
 
-func (d *DHT) sendMessage(addr *net.UDPAddr, data []byte) (err error) {
+func (d *DHT) sendMessage(prio SendPriority, addr *net.UDPAddr, data []byte) error {
+	return d.pacer.Send(prio, addr, data, d.write)
+}
+
+// writeQuery returns the write of a query, which records the
+// transaction when the query is sent, it may be deferred by the pacer
+func (d *DHT) writeQuery(tid []byte) func(*net.UDPAddr, []byte) error {
+	return func(addr *net.UDPAddr, data []byte) (err error) {
+		if err = d.write(addr, data); err == nil {
+			d.trans.Insert(addr, tid)
+		}
+		return
+	}
+}
+
+func (d *DHT) write(addr *net.UDPAddr, data []byte) (err error) {
 	for n, nn := 0, 0; nn < len(data); nn += n {
-		n, err = d.conn.WriteToUDP(data[nn:], addr)
+		n, err = d.conn.WriteTo(data[nn:], addr)
 		if err != nil {
 			break
 		}
@@ -484,28 +1035,52 @@ func (d *DHT) sendMessage(addr *net.UDPAddr, data []byte) (err error) {
 	return
 }
 
-func (d *DHT) queryMessage(q string, no int16, addr *net.UDPAddr, data map[string]interface{}) (err error) {
-	msg := newQueryMessage(encodeTID(q, no), q, data)
-	if b, err := encodeMessage(msg); err == nil {
-		err = d.sendMessage(addr, b)
+func (d *DHT) queryMessage(q string, no int16, addr *net.UDPAddr, data map[string]interface{}, prio SendPriority) (err error) {
+	tid := encodeTID(q, no)
+	b, err := encodeMessage(d.newQueryMessage(tid, q, data))
+	if err == nil {
+		d.reach.Contact(addr.IP)
+		err = d.pacer.Send(prio, addr, b, d.writeQuery(tid))
 	}
 	return
 }
 
+// newQueryMessage returns a query, it is read only if DHT is firewalled
+// and not probing
+func (d *DHT) newQueryMessage(tid []byte, q string, data map[string]interface{}) *kadQueryMessage {
+	msg := newQueryMessage(tid, q, data)
+	if d.reach.ReadOnly() {
+		msg.RO = 1
+	}
+	return msg
+}
+
 func (d *DHT) replyMessage(tid []byte, addr *net.UDPAddr, data map[string]interface{}) (err error) {
 	msg := newReplyMessage(tid, data)
 	if b, err := encodeMessage(msg); err == nil {
-		err = d.sendMessage(addr, b)
+		err = d.sendMessage(SendReply, addr, b)
 	}
 	return
 }
 
-func (d *DHT) batchQueryMessage(q string, no int16, addrs []*net.UDPAddr, data map[string]interface{}) (n int, err error) {
-	msg := newQueryMessage(encodeTID(q, no), q, data)
+func (d *DHT) replyError(tid []byte, addr *net.UDPAddr, code int, s string) (err error) {
+	msg := newErrorMessage(tid, code, s)
 	if b, err := encodeMessage(msg); err == nil {
+		err = d.sendMessage(SendReply, addr, b)
+	}
+	return
+}
+
+// batchQueryMessage returns count of the packets sent or deferred
+func (d *DHT) batchQueryMessage(q string, no int16, addrs []*net.UDPAddr, data map[string]interface{}, prio SendPriority) (n int, err error) {
+	tid := encodeTID(q, no)
+	write := d.writeQuery(tid)
+	b, err := encodeMessage(d.newQueryMessage(tid, q, data))
+	if err == nil {
 		for _, addr := range addrs {
-			err = d.sendMessage(addr, b)
-			if err != nil {
+			d.reach.Contact(addr.IP)
+			err = d.pacer.Send(prio, addr, b, write)
+			if err != nil && err != ErrSendDeferred {
 				break
 			}
 			n++
@@ -553,8 +1128,12 @@ func decodeTID(tid []byte) (q string, id int16) {
 func encodeCompactNodes(nodes []*Node) []byte {
 	buf := bytes.NewBuffer(nil)
 	for _, n := range nodes {
+		ip := n.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
 		buf.Write(n.id.Bytes())
-		buf.Write(n.addr.IP)
+		buf.Write(ip)
 		buf.WriteByte(byte(n.addr.Port >> 8))
 		buf.WriteByte(byte(n.addr.Port))
 	}
@@ -564,6 +1143,8 @@ func encodeCompactNodes(nodes []*Node) []byte {
 func decodeCompactNode(b []byte) map[*ID]*net.UDPAddr {
 	nodes := make(map[*ID]*net.UDPAddr)
 	for id, peer := range ResolveNodes(b) {
+		// the key must not be the address of loop variable
+		id := id
 		ip, port := ResolvePeer(peer)
 		s := fmt.Sprintf("%s:%d", ip, port)
 		addr, err := net.ResolveUDPAddr("udp", s)
@@ -2,7 +2,11 @@ package dht
 
 import (
 	"math"
+	"net"
 	"testing"
+	"time"
+
+	"github.com/4396/dht/memnet"
 )
 
 func Test_TID(t *testing.T) {
@@ -21,3 +25,157 @@ func testTID(t *testing.T, q string, id int16) {
 		t.Fatal(q, id, q2, id2)
 	}
 }
+
+func Test_decodeCompactNode(t *testing.T) {
+	var nodes []*Node
+	for i := 0; i < 8; i++ {
+		nodes = append(nodes, NewNode(newRandomID(), &net.UDPAddr{IP: net.IPv4(1, 2, 3, byte(i)), Port: 6881}))
+	}
+	m := decodeCompactNode(encodeCompactNodes(nodes))
+	if len(m) != len(nodes) {
+		t.Fatal(len(m))
+	}
+	for id, addr := range m {
+		if n := nodes[addr.IP.To4()[3]]; *n.id != *id {
+			t.Fatal(id, addr)
+		}
+	}
+}
+
+// newTestDHT returns DHT on an in-memory network, the connection is
+// closed at the end of test
+func newTestDHT(t *testing.T) *DHT {
+	conn, err := memnet.NewNetwork(1).Listen(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return NewDHT(newRandomID(), conn, 8)
+}
+
+func Test_DHT_deferredQuery(t *testing.T) {
+	d := newTestDHT(t)
+	d.SetSendRate(1, 0, 16)
+	d.Ping(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 5), Port: 6881})
+	if err := d.Ping(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 6), Port: 6881}); err != ErrSendDeferred {
+		t.Fatal(err)
+	}
+	if n := d.trans.Count(); n != 1 {
+		t.Fatal(n)
+	}
+	// the transaction of a deferred query is recorded when it is sent
+	d.pacer.packets.tokens = 1
+	if d.Flush() != 1 || d.trans.Count() != 2 {
+		t.Fatal(d.trans.Count())
+	}
+}
+
+func Test_DHT_handleGetPeers(t *testing.T) {
+	d := newTestDHT(t)
+	tor := newRandomID()
+	tid, sr := d.searches.Insert(tor, nil, 1)
+	// a full path of answered nodes
+	var from *ID
+	for i := 0; i < 16; i++ {
+		from = newRandomID()
+		sr.Insert(from, &net.UDPAddr{IP: net.IPv4(1, 2, 4, byte(i)), Port: 6881}, time.Second, 0).acked = true
+	}
+
+	near, far := *tor, *tor
+	near[IDLen-1] ^= 1
+	for i := range far {
+		far[i] ^= 0xff
+	}
+	nodes := []*Node{
+		NewNode(&near, &net.UDPAddr{IP: net.IPv4(1, 2, 5, 1), Port: 6881}),
+		NewNode(&far, &net.UDPAddr{IP: net.IPv4(1, 2, 5, 2), Port: 6881}),
+	}
+	d.handleGetPeers(tid, from, nil, encodeCompactNodes(nodes))
+	if sr.Get(&near) == nil || sr.Get(&far) != nil || sr.Count() != 17 {
+		t.Fatal(sr.Count())
+	}
+}
+
+func Test_DHT_SetQueryTimeout(t *testing.T) {
+	d := newTestDHT(t)
+	d.SetQueryTimeout(time.Second, 100*time.Millisecond, 2*time.Second)
+	id := newRandomID()
+	if tm := d.timeout(id); tm != time.Second {
+		t.Fatal(tm)
+	}
+	n, _ := d.route.Insert(id, &net.UDPAddr{IP: net.IPv4(1, 2, 3, 5), Port: 6881})
+	if n.Sample(time.Minute); d.timeout(id) != 2*time.Second {
+		t.Fatal(d.timeout(id))
+	}
+	if d.verifies.timeout != time.Second {
+		t.Fatal(d.verifies.timeout)
+	}
+}
+
+func Test_DHT_getPeers(t *testing.T) {
+	d := newTestDHT(t)
+	tor := newRandomID()
+	for i := 0; i < 200; i++ {
+		d.store.Insert(tor, peer(i))
+	}
+	if ps := d.getPeers(tor, 0, 0); len(ps) != 200 {
+		t.Fatal(len(ps))
+	}
+	if ps := d.getPeers(tor, 0, 20); len(ps) != 20 || string(ps[0]) != string(peer(199)) {
+		t.Fatal(len(ps))
+	}
+}
+
+func Test_DHT_insertOrUpdate(t *testing.T) {
+	d := newTestDHT(t)
+	var id *ID
+	var addr *net.UDPAddr
+	for i := 0; id == nil; i++ {
+		a := &net.UDPAddr{IP: net.IPv4(1, byte(i>>8), byte(i), 1), Port: 6881}
+		nid := newRandomID()
+		if n, err := d.route.Insert(nid, a); err == errBucketFull {
+			id, addr = nid, a
+		} else if n != nil {
+			n.Replied()
+		}
+	}
+	// the cached node is not refreshed from another address
+	if n, _ := d.insertOrUpdate(id, &net.UDPAddr{IP: net.IPv4(9, 9, 9, 9), Port: 6881}); n != nil {
+		t.Fatal(n.addr)
+	}
+	if n, _ := d.insertOrUpdate(id, addr); n == nil || n.addr != addr {
+		t.Fatal(n)
+	}
+}
+
+func Test_DHT_cleanBucket(t *testing.T) {
+	d := newTestDHT(t)
+	n, _ := d.route.Insert(newRandomID(), &net.UDPAddr{IP: net.IPv4(1, 2, 3, 5), Port: 6881})
+	b := d.route.Find(n.id)
+	// a pending ping fails only after it times out
+	for i := 0; i < 4; i++ {
+		d.cleanBucket(b, time.Hour)
+	}
+	if n.pinged != 1 || n.fails != 0 || b.Find(n.id) == nil {
+		t.Fatal(n.pinged, n.fails)
+	}
+	n.ping = time.Now().Add(-n.Timeout() - time.Second)
+	if d.cleanBucket(b, time.Hour); n.fails != 1 || n.pinged != 1 {
+		t.Fatal(n.pinged, n.fails)
+	}
+}
+
+func Test_DHT_handleReplyMessage(t *testing.T) {
+	d := newTestDHT(t)
+	id := newRandomID()
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 5), Port: 6881}
+	tid := encodeTID("ping", 0)
+	// an unsolicited reply doesn't admit the sender
+	if d.handleReplyMessage(addr, tid, &kadResponse{ID: id[:]}, nil); d.find(id) != nil {
+		t.Fatal(id)
+	}
+	d.trans.Insert(addr, tid)
+	if d.handleReplyMessage(addr, tid, &kadResponse{ID: id[:]}, nil); d.find(id) == nil {
+		t.Fatal(id)
+	}
+}
@@ -0,0 +1,46 @@
+package dht
+
+import "math"
+
+// sizeEstimator estimates count of nodes of DHT from the k closest
+// nodes of lookups. In a network of N nodes spread evenly, the i-th
+// closest node to a target is expected at distance i/N, so that N is
+// fitted by least squares and smoothed by moving average of its log.
+type sizeEstimator struct {
+	alpha float64
+	log   float64
+}
+
+func newSizeEstimator(alpha float64) *sizeEstimator {
+	return &sizeEstimator{alpha: alpha}
+}
+
+// Add the closest nodes of a lookup, sorted by distance to target
+func (e *sizeEstimator) Add(target *ID, ids []*ID) {
+	// too few nodes make a noisy sample
+	if len(ids) < 4 {
+		return
+	}
+	var sii, sid float64
+	for i, id := range ids {
+		n := float64(i + 1)
+		sii += n * n
+		sid += n * target.distance(id)
+	}
+	if sid <= 0 {
+		return
+	}
+	if size := math.Log(sii / sid); e.log == 0 {
+		e.log = size
+	} else {
+		e.log += e.alpha * (size - e.log)
+	}
+}
+
+// Estimate returns estimated count of nodes, 0 if unknown
+func (e *sizeEstimator) Estimate() int {
+	if e.log == 0 {
+		return 0
+	}
+	return int(math.Exp(e.log) + 0.5)
+}
@@ -0,0 +1,27 @@
+package dht
+
+import (
+	"sort"
+	"testing"
+)
+
+func Test_sizeEstimator(t *testing.T) {
+	ids := make([]*ID, 10000)
+	for i := range ids {
+		ids[i] = newRandomID()
+	}
+	e := newSizeEstimator(0.05)
+	if e.Estimate() != 0 {
+		t.Fatal(e.Estimate())
+	}
+	for i := 0; i < 200; i++ {
+		target := newRandomID()
+		sort.Slice(ids, func(i, j int) bool {
+			return target.cmpDistance(ids[i], ids[j]) < 0
+		})
+		e.Add(target, ids[:8])
+	}
+	if n := e.Estimate(); n < 7000 || n > 14000 {
+		t.Fatal(n)
+	}
+}
@@ -100,7 +100,7 @@ func main() {
 		return
 	}
 
-	d := dht.NewDHT(newRandomID(), conn.(*net.UDPConn), 16)
+	d := dht.NewDHT(newRandomID(), conn, 16)
 	t := dht.NewTracker(&dhtQueryTracker{}, &dhtReplyTracker{}, &dhtErrorTracker{})
 	exit := make(chan interface{})
 	msg := make(chan *udpMessage, 1024)
@@ -114,20 +114,20 @@ func main() {
 			close(exit)
 			return
 		}
-		conn := d.Conn()
 		buf := datas.Get().([]byte)
 		for {
-			n, addr, err := conn.ReadFromUDP(buf)
+			n, addr, err := conn.ReadFrom(buf)
 			if err != nil {
 				fmt.Println(err)
 				continue
 			}
-			msg <- &udpMessage{addr, buf, n}
+			msg <- &udpMessage{addr.(*net.UDPAddr), buf, n}
 		}
 	}(msg)
 
 	timer := time.Tick(time.Second * 30)
 	checkup := time.Tick(time.Second * 30)
+	pace := time.Tick(time.Millisecond * 100)
 
 	for {
 		select {
@@ -138,12 +138,14 @@ func main() {
 			}
 		case <-timer:
 			if n := d.Route().NumNodes(); n < 1024 {
-				d.DoTimer(time.Minute*15, time.Minute*15, time.Hour*6, time.Minute*5)
+				d.DoTimer(time.Minute*15, time.Hour*6, time.Minute*5)
 			}
 		case <-checkup:
 			if n := d.Route().NumNodes(); n < 1024 {
 				d.FindNode(d.ID())
 			}
+		case <-pace:
+			d.Flush()
 		case <-exit:
 			return
 		default:
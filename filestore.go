@@ -0,0 +1,155 @@
+package dht
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+	"time"
+)
+
+// a record of log is 20 bytes infohash, 8 bytes announce time in
+// unix nanoseconds, 1 byte peer length and the peer
+const recordHeader = 20 + 8 + 1
+
+// FileStore is a PeerStore kept in memory and logged to an append
+// only file. The file is replayed on open, and rewritten with the
+// live peers once most of its records are stale.
+type FileStore struct {
+	*MemoryStore
+	name    string
+	file    *os.File
+	records int
+	// the last error of compaction in Expire
+	err error
+}
+
+// OpenFileStore open or create a FileStore, a truncated record at
+// the end of file is dropped
+func OpenFileStore(name string) (*FileStore, error) {
+	s := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		name:        name,
+	}
+	file, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	n, err := s.replay(file)
+	if err == nil {
+		err = file.Truncate(n)
+	}
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	if s.file, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay insert the records of file, returns size of the complete records
+func (s *FileStore) replay(file *os.File) (n int64, err error) {
+	r := bufio.NewReader(file)
+	var head [recordHeader]byte
+	for {
+		if _, err = io.ReadFull(r, head[:]); err != nil {
+			break
+		}
+		peer := make([]byte, head[recordHeader-1])
+		if _, err = io.ReadFull(r, peer); err != nil {
+			break
+		}
+		tor, _ := NewID(head[:20])
+		t := time.Unix(0, int64(binary.BigEndian.Uint64(head[20:28])))
+		s.MemoryStore.insert(tor, peer, t)
+		s.records++
+		n += int64(len(head) + len(peer))
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return
+}
+
+func appendRecord(b []byte, tor *ID, peer []byte, t time.Time) []byte {
+	var tm [8]byte
+	binary.BigEndian.PutUint64(tm[:], uint64(t.UnixNano()))
+	b = append(b, tor.Bytes()...)
+	b = append(b, tm[:]...)
+	b = append(b, byte(len(peer)))
+	return append(b, peer...)
+}
+
+// Insert a peer and log it
+func (s *FileStore) Insert(tor *ID, peer []byte) error {
+	t := time.Now()
+	if err := s.MemoryStore.insert(tor, peer, t); err != nil {
+		return err
+	}
+	if _, err := s.file.Write(appendRecord(nil, tor, peer, t)); err != nil {
+		return err
+	}
+	s.records++
+	return nil
+}
+
+// Expire remove the peers announced before tm ago, and compact the
+// file if less than half of its records are live, see Err
+func (s *FileStore) Expire(tm time.Duration) {
+	s.MemoryStore.Expire(tm)
+	if s.records > 1024 && s.records > 2*s.Stats().Peers {
+		s.err = s.Compact()
+	}
+}
+
+// Err returns the error of the last compaction in Expire, the file
+// keeps growing while it fails
+func (s *FileStore) Err() error {
+	return s.err
+}
+
+// Compact rewrite the file with the live peers, the log goes on in
+// the old file if it fails
+func (s *FileStore) Compact() error {
+	tmp := s.name + ".tmp"
+	// the new file is the append handle after rename
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	records := 0
+	var b []byte
+	// in announce order as the log, Expire relies on it after replay
+	s.mapAnnounced(func(tor *ID, peer []byte, t time.Time) bool {
+		b = appendRecord(b[:0], tor, peer, t)
+		_, err = w.Write(b)
+		records++
+		return err == nil
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.name)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	s.file.Close()
+	s.file = file
+	s.records = records
+	return nil
+}
+
+// Close the file
+func (s *FileStore) Close() error {
+	return s.file.Close()
+}
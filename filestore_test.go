@@ -0,0 +1,128 @@
+package dht
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_FileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dht")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "peers")
+
+	s, err := OpenFileStore(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := newRandomID()
+	for i := 0; i < 3; i++ {
+		if err = s.Insert(id, peer(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Insert(id, peer(0))
+	s.Close()
+
+	// a truncated record is dropped
+	f, _ := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write([]byte{1, 2, 3})
+	f.Close()
+
+	if s, err = OpenFileStore(name); err != nil {
+		t.Fatal(err)
+	}
+	if ps := s.Lookup(id, 0); len(ps) != 3 || !bytes.Equal(ps[0], peer(0)) {
+		t.Fatal(ps)
+	}
+	if s.records != 4 {
+		t.Fatal(s.records)
+	}
+	if err = s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	s.Insert(newRandomID(), peer(1))
+	s.Close()
+
+	if s, err = OpenFileStore(name); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.records != 4 || s.Count() != 2 || s.NumPeers(id) != 3 {
+		t.Fatal(s.records, s.Count())
+	}
+	s.Expire(-time.Second)
+	if s.Count() != 0 {
+		t.Fatal(s.Count())
+	}
+}
+
+func Test_FileStore_Err(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dht")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "peers")
+	s, err := OpenFileStore(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the temporary file can't be created
+	os.Mkdir(name+".tmp", 0755)
+	id := newRandomID()
+	s.Insert(id, peer(0))
+	s.records = 2000
+	if s.Expire(time.Hour); s.Err() == nil {
+		t.Fatal("compact")
+	}
+	if err = s.Insert(id, peer(1)); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(name + ".tmp")
+	if s.Expire(time.Hour); s.Err() != nil || s.records != 2 {
+		t.Fatal(s.Err(), s.records)
+	}
+	if err = s.Insert(id, peer(2)); err != nil || s.records != 3 {
+		t.Fatal(err)
+	}
+}
+
+func Test_FileStore_CompactExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dht")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "peers")
+	s, err := OpenFileStore(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old, fresh := newRandomID(), newRandomID()
+	s.MemoryStore.insert(old, peer(0), time.Now().Add(-2*time.Hour))
+	s.Insert(fresh, peer(1))
+	// the infohash of the stale peer is queried last
+	s.Lookup(old, 0)
+	if err = s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	if s, err = OpenFileStore(name); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Expire(time.Hour)
+	if s.NumPeers(old) != 0 || s.NumPeers(fresh) != 1 {
+		t.Fatal(s.NumPeers(old), s.NumPeers(fresh))
+	}
+}
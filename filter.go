@@ -0,0 +1,227 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// IPRange is a range of blocked addresses
+type IPRange struct {
+	First net.IP
+	Last  net.IP
+	Name  string
+}
+
+func (r IPRange) String() string {
+	return fmt.Sprintf("%s:%s-%s", r.Name, r.First, r.Last)
+}
+
+type filterRange struct {
+	hits  uint64
+	first net.IP
+	last  net.IP
+	// max last of this and all previous ranges
+	max  net.IP
+	name string
+}
+
+// IPFilter blocks the addresses of some ranges. It is safe for
+// concurrent use and can be reloaded at runtime.
+type IPFilter struct {
+	ranges atomic.Value
+}
+
+// NewIPFilter returns an empty filter
+func NewIPFilter() *IPFilter {
+	f := &IPFilter{}
+	f.ranges.Store([]*filterRange(nil))
+	return f
+}
+
+// LoadFile replace the ranges with a file, see Load
+func (f *IPFilter) LoadFile(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return f.Load(file)
+}
+
+// Load replace the ranges with a list of CIDR, eMule ipfilter.dat or
+// PeerGuardian P2P text lines, the old ranges are kept on error
+func (f *IPFilter) Load(r io.Reader) error {
+	var ranges []IPRange
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' || strings.HasPrefix(line, "//") {
+			continue
+		}
+		r, ok, err := parseIPRange(line)
+		if err != nil {
+			return fmt.Errorf("ipfilter: line %d: %v", n, err)
+		}
+		if ok {
+			ranges = append(ranges, r)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	return f.Set(ranges)
+}
+
+// Set replace the ranges
+func (f *IPFilter) Set(ranges []IPRange) error {
+	frs := make([]*filterRange, 0, len(ranges))
+	for _, r := range ranges {
+		first, last := r.First.To16(), r.Last.To16()
+		if first == nil || last == nil || bytes.Compare(first, last) > 0 {
+			return fmt.Errorf("ipfilter: invalid range %v", r)
+		}
+		frs = append(frs, &filterRange{first: first, last: last, name: r.Name})
+	}
+	sort.Slice(frs, func(i, j int) bool {
+		return bytes.Compare(frs[i].first, frs[j].first) < 0
+	})
+	for i, fr := range frs {
+		fr.max = fr.last
+		if i > 0 && bytes.Compare(frs[i-1].max, fr.max) > 0 {
+			fr.max = frs[i-1].max
+		}
+	}
+	f.ranges.Store(frs)
+	return nil
+}
+
+// Count returns count of ranges
+func (f *IPFilter) Count() int {
+	return len(f.ranges.Load().([]*filterRange))
+}
+
+// Blocked returns true if ip is in a range, and counts the hit
+func (f *IPFilter) Blocked(ip net.IP) bool {
+	ip = ip.To16()
+	if ip == nil {
+		return false
+	}
+	frs := f.ranges.Load().([]*filterRange)
+	i := sort.Search(len(frs), func(i int) bool {
+		return bytes.Compare(frs[i].first, ip) > 0
+	})
+	for i--; i >= 0 && bytes.Compare(frs[i].max, ip) >= 0; i-- {
+		if bytes.Compare(frs[i].last, ip) >= 0 {
+			atomic.AddUint64(&frs[i].hits, 1)
+			return true
+		}
+	}
+	return false
+}
+
+// Map all ranges with their hit counts
+func (f *IPFilter) Map(fn func(r IPRange, hits uint64) bool) {
+	for _, fr := range f.ranges.Load().([]*filterRange) {
+		r := IPRange{First: fr.first, Last: fr.last, Name: fr.name}
+		if fn(r, atomic.LoadUint64(&fr.hits)) == false {
+			return
+		}
+	}
+}
+
+// parseIPRange parse a line of
+//
+//	CIDR:          1.2.3.0/24
+//	ipfilter.dat:  001.002.003.000 - 001.002.003.255 , 000 , Name
+//	P2P:           Name:1.2.3.0-1.2.3.255
+//
+// ok is false if the range is allowed by its ipfilter.dat access level
+func parseIPRange(line string) (r IPRange, ok bool, err error) {
+	// the name of a P2P line may have commas and colons
+	if i := strings.LastIndex(line, ":"); i >= 0 && strings.Count(line[i+1:], ".") == 6 {
+		r.Name = strings.TrimSpace(line[:i])
+		r.First, r.Last, err = parseIPPair(line[i+1:])
+		return r, err == nil, err
+	}
+	switch {
+	case strings.Contains(line, ","):
+		fields := strings.SplitN(line, ",", 3)
+		if len(fields) < 2 {
+			return r, false, fmt.Errorf("invalid ipfilter.dat line")
+		}
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return r, false, err
+		}
+		if len(fields) == 3 {
+			r.Name = strings.TrimSpace(fields[2])
+		}
+		r.First, r.Last, err = parseIPPair(fields[0])
+		return r, err == nil && level < 128, err
+	case strings.Contains(line, "-"):
+		r.First, r.Last, err = parseIPPair(line)
+		return r, err == nil, err
+	case strings.Contains(line, "/"):
+		_, ipnet, err := net.ParseCIDR(line)
+		if err != nil {
+			return r, false, err
+		}
+		r.First = ipnet.IP.To16()
+		r.Last = make(net.IP, len(r.First))
+		mask := ipnet.Mask
+		if len(mask) == net.IPv4len {
+			mask = append(net.CIDRMask(96, 128)[:12], mask...)
+		}
+		for i := range r.First {
+			r.Last[i] = r.First[i] | ^mask[i]
+		}
+		return r, true, nil
+	}
+	ip := parseIP(line)
+	if ip == nil {
+		return r, false, fmt.Errorf("invalid address %q", line)
+	}
+	r.First, r.Last = ip, ip
+	return r, true, nil
+}
+
+func parseIPPair(s string) (first, last net.IP, err error) {
+	i := strings.Index(s, "-")
+	if i < 0 {
+		return nil, nil, fmt.Errorf("invalid range %q", s)
+	}
+	first, last = parseIP(s[:i]), parseIP(s[i+1:])
+	if first == nil || last == nil {
+		return nil, nil, fmt.Errorf("invalid range %q", s)
+	}
+	return
+}
+
+// parseIP accepts the zero padded IPv4 addresses of ipfilter.dat
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		return net.ParseIP(s)
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return nil
+	}
+	var b [4]byte
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		b[i] = byte(n)
+	}
+	return net.IPv4(b[0], b[1], b[2], b[3])
+}
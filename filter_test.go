@@ -0,0 +1,53 @@
+package dht
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func Test_IPFilter(t *testing.T) {
+	list := `# comment
+10.0.0.0/8
+001.002.003.000 - 001.002.003.255 , 000 , Some Network
+005.006.007.000 - 005.006.007.255 , 200 , Allowed Network
+Bad Guys: Inc:8.8.4.0-8.8.4.255
+Acme, Inc:1.2.5.0-1.2.5.255
+2001:db8::/32
+`
+	f := NewIPFilter()
+	if err := f.Load(strings.NewReader(list)); err != nil {
+		t.Fatal(err)
+	}
+	if f.Count() != 5 {
+		t.Fatal(f.Count())
+	}
+	for ip, blocked := range map[string]bool{
+		"10.1.2.3":    true,
+		"1.2.3.4":     true,
+		"1.2.4.4":     false,
+		"1.2.5.4":     true,
+		"5.6.7.8":     false,
+		"8.8.4.4":     true,
+		"8.8.8.8":     false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+	} {
+		if f.Blocked(net.ParseIP(ip)) != blocked {
+			t.Fatal(ip, blocked)
+		}
+	}
+	f.Map(func(r IPRange, hits uint64) bool {
+		if hits != 1 {
+			t.Fatal(r, hits)
+		}
+		if r.First.Equal(net.ParseIP("8.8.4.0")) && r.Name != "Bad Guys: Inc" ||
+			r.First.Equal(net.ParseIP("1.2.5.0")) && r.Name != "Acme, Inc" {
+			t.Fatal(r)
+		}
+		return true
+	})
+	if err := f.Load(strings.NewReader("bogus")); err == nil || f.Count() != 5 {
+		t.Fatal(err, f.Count())
+	}
+}
@@ -3,6 +3,8 @@ package dht
 import (
 	"encoding/hex"
 	"fmt"
+	"math"
+	"math/bits"
 )
 
 // ZeroID "0000000000000000000000000000000000000000"
@@ -51,6 +53,16 @@ func (id *ID) Compare(o *ID) int {
 	return 0
 }
 
+// PrefixLen returns the count of leading bits shared by two id
+func (id *ID) PrefixLen(o *ID) int {
+	for i := 0; i < IDLen; i++ {
+		if x := id[i] ^ o[i]; x != 0 {
+			return 8*i + bits.LeadingZeros8(x)
+		}
+	}
+	return 8 * IDLen
+}
+
 // LowBit find the lowest 1 bit in an id
 func (id *ID) LowBit() int {
 	var i, j int
@@ -86,6 +98,43 @@ func (id *ID) GetBit(i int) (bool, error) {
 	return n != 0, nil
 }
 
+// prefix returns an id which keeps the first n bits of id,
+// bit n is flipped if flip is true
+func (id *ID) prefix(n int, flip bool) *ID {
+	p := new(ID)
+	for i := 0; i < n; i++ {
+		b, _ := id.GetBit(i)
+		p.SetBit(i, b)
+	}
+	if flip && n < 8*IDLen {
+		b, _ := id.GetBit(n)
+		p.SetBit(n, !b)
+	}
+	return p
+}
+
+// cmpDistance compare the xor distance of a and b to id
+func (id *ID) cmpDistance(a, b *ID) int {
+	for i := 0; i < IDLen; i++ {
+		n1, n2 := a[i]^id[i], b[i]^id[i]
+		if n1 < n2 {
+			return -1
+		} else if n1 > n2 {
+			return 1
+		}
+	}
+	return 0
+}
+
+// distance returns xor distance of o to id as a fraction of id space
+func (id *ID) distance(o *ID) float64 {
+	var f float64
+	for i := 0; i < 8; i++ {
+		f = f*256 + float64(id[i]^o[i])
+	}
+	return math.Ldexp(f, -64)
+}
+
 // Bytes return 20 bytes
 func (id *ID) Bytes() []byte {
 	return id[:]
@@ -25,6 +25,8 @@ type kadQueryMessage struct {
 	Y string                 `bencode:"y"`
 	Q string                 `bencode:"q"`
 	A map[string]interface{} `bencode:"a"`
+	// RO is 1 if the sender is read only, see BEP 43
+	RO int `bencode:"ro,omitempty"`
 }
 
 type kadReplyMessage struct {
@@ -33,14 +35,24 @@ type kadReplyMessage struct {
 	R map[string]interface{} `bencode:"r"`
 }
 
+type kadErrorMessage struct {
+	T []byte        `bencode:"t"`
+	Y string        `bencode:"y"`
+	E []interface{} `bencode:"e"`
+}
+
 func newQueryMessage(tid []byte, q string, data map[string]interface{}) *kadQueryMessage {
-	return &kadQueryMessage{tid, "q", q, data}
+	return &kadQueryMessage{T: tid, Y: "q", Q: q, A: data}
 }
 
 func newReplyMessage(tid []byte, data map[string]interface{}) *kadReplyMessage {
 	return &kadReplyMessage{tid, "r", data}
 }
 
+func newErrorMessage(tid []byte, code int, msg string) *kadErrorMessage {
+	return &kadErrorMessage{tid, "e", []interface{}{code, msg}}
+}
+
 type kadArguments struct {
 	ID       []byte `bencode:"id"`
 	Port     int64  `bencode:"port"`
@@ -57,12 +69,13 @@ type kadResponse struct {
 }
 
 type kadMessage struct {
-	T []byte        `bencode:"t"`
-	Y string        `bencode:"y"`
-	Q string        `bencode:"q"`
-	E []interface{} `bencode:"e"`
-	A kadArguments  `bencode:"a"`
-	R kadResponse   `bencode:"r"`
+	T  []byte        `bencode:"t"`
+	Y  string        `bencode:"y"`
+	Q  string        `bencode:"q"`
+	E  []interface{} `bencode:"e"`
+	A  kadArguments  `bencode:"a"`
+	R  kadResponse   `bencode:"r"`
+	RO int64         `bencode:"ro"`
 }
 
 // ResolvePeer returns ip and port
@@ -70,6 +83,9 @@ func ResolvePeer(peer []byte) (ip string, port int) {
 	if n := len(peer); n == 6 {
 		ip = net.IPv4(peer[0], peer[1], peer[2], peer[3]).String()
 		port = (int(peer[4]) << 8) | int(peer[5])
+	} else if n == 18 {
+		ip = net.IP(peer[:16]).String()
+		port = (int(peer[16]) << 8) | int(peer[17])
 	}
 	return
 }
@@ -17,3 +17,18 @@ func Test_ResolvePeer(t *testing.T) {
 		}
 	}
 }
+
+func Test_ReadOnlyQuery(t *testing.T) {
+	msg := newQueryMessage([]byte("aa"), "ping", map[string]interface{}{"id": ZeroID.Bytes()})
+	for _, ro := range []int{0, 1} {
+		msg.RO = ro
+		b, err := encodeMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m kadMessage
+		if err = decodeMessage(b, &m); err != nil || m.RO != int64(ro) {
+			t.Fatal(err, m.RO, string(b))
+		}
+	}
+}
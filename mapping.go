@@ -0,0 +1,120 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/4396/dht/portmap"
+)
+
+// portMapping keeps the udp port mapped on gateway, it is renewed in
+// background at half of the granted lifetime
+type portMapping struct {
+	mu     sync.Mutex
+	mapper portmap.Mapper
+	// nil after the mapping expires without renewal
+	mapping  *portmap.Mapping
+	lifetime time.Duration
+	// external address changed since last Changed
+	changed bool
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+func newPortMapping(m portmap.Mapper, port int, lifetime time.Duration) (*portMapping, error) {
+	mp, err := m.AddMapping("udp", port, port, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	p := &portMapping{
+		mapper:   m,
+		mapping:  mp,
+		lifetime: lifetime,
+		changed:  true,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.renew()
+	return p, nil
+}
+
+func (p *portMapping) renew() {
+	defer close(p.done)
+	p.mu.Lock()
+	mp := p.mapping
+	p.mu.Unlock()
+	expires := mappingExpires(mp)
+	wait := mp.Lifetime / 2
+	for {
+		if wait <= 0 {
+			wait = time.Hour
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(wait):
+		}
+		m, err := p.mapper.AddMapping("udp", mp.InternalPort, mp.ExternalPort, p.lifetime)
+		if err != nil {
+			// keep the old mapping, retry before it expires
+			if wait > time.Minute {
+				wait = time.Minute
+			}
+			if !expires.IsZero() && time.Now().After(expires) {
+				p.mu.Lock()
+				if p.mapping != nil {
+					p.mapping = nil
+					p.changed = true
+				}
+				p.mu.Unlock()
+			}
+			continue
+		}
+		p.mu.Lock()
+		if p.mapping == nil || !m.ExternalIP.Equal(p.mapping.ExternalIP) ||
+			m.ExternalPort != p.mapping.ExternalPort {
+			p.changed = true
+		}
+		p.mapping = m
+		p.mu.Unlock()
+		mp, wait, expires = m, m.Lifetime/2, mappingExpires(m)
+	}
+}
+
+// mappingExpires returns when m expires, zero if it is permanent
+func mappingExpires(m *portmap.Mapping) time.Time {
+	if m.Lifetime <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(m.Lifetime)
+}
+
+// Addr returns the mapped external address, nil if it expired
+func (p *portMapping) Addr() *net.UDPAddr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mapping == nil {
+		return nil
+	}
+	return &net.UDPAddr{IP: p.mapping.ExternalIP, Port: p.mapping.ExternalPort}
+}
+
+// Changed returns whether external address changed since last call
+func (p *portMapping) Changed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	changed := p.changed
+	p.changed = false
+	return changed
+}
+
+// Close stop renewing and remove the mapping
+func (p *portMapping) Close() error {
+	close(p.stop)
+	<-p.done
+	if p.mapping == nil {
+		return nil
+	}
+	return p.mapper.DeleteMapping(p.mapping)
+}
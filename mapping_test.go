@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/4396/dht/portmap"
+)
+
+type testMapper struct {
+	mu      sync.Mutex
+	adds    int
+	deletes int
+	port    int
+	fail    bool
+}
+
+func (m *testMapper) AddMapping(protocol string, internal, external int, lifetime time.Duration) (*portmap.Mapping, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.adds++
+	if m.fail {
+		return nil, errors.New("no gateway")
+	}
+	return &portmap.Mapping{
+		Protocol:     protocol,
+		InternalPort: internal,
+		ExternalIP:   net.IPv4(203, 0, 113, 7),
+		ExternalPort: m.port,
+		Lifetime:     lifetime,
+	}, nil
+}
+
+func (m *testMapper) DeleteMapping(mp *portmap.Mapping) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deletes++
+	return nil
+}
+
+func Test_MapPort(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	d := NewDHT(newRandomID(), conn, 8)
+	if d.ExternalAddr() != nil {
+		t.Fatal(d.ExternalAddr())
+	}
+
+	m := &testMapper{port: 40000}
+	if err = d.MapPort(m, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if addr := d.ExternalAddr(); addr.String() != "203.0.113.7:40000" {
+		t.Fatal(addr)
+	}
+	if !d.mapping.Changed() || d.mapping.Changed() {
+		t.Fatal("changed")
+	}
+
+	m.mu.Lock()
+	m.port = 40001
+	m.mu.Unlock()
+	time.Sleep(120 * time.Millisecond)
+	if addr := d.ExternalAddr(); addr.Port != 40001 {
+		t.Fatal(addr)
+	}
+	d.reach.replies = 1
+	d.DoTimer(time.Minute, time.Hour, time.Minute)
+	if d.reach.replies != 0 {
+		t.Fatal(d.reach.replies)
+	}
+
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.adds < 2 || m.deletes != 1 || d.ExternalAddr() != nil {
+		t.Fatal(m.adds, m.deletes)
+	}
+}
+
+func Test_MapPort_Expire(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	d := NewDHT(newRandomID(), conn, 8)
+	m := &testMapper{port: 40000}
+	if err = d.MapPort(m, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	// the nodes at our own address are left out
+	ext := d.ExternalAddr()
+	d.verify(newRandomID(), ext)
+	if _, err = d.insertOrUpdate(newRandomID(), ext); err == nil || d.verifies.Count() != 0 {
+		t.Fatal(err, d.verifies.Count())
+	}
+
+	m.mu.Lock()
+	m.fail = true
+	m.mu.Unlock()
+	time.Sleep(250 * time.Millisecond)
+	if addr := d.ExternalAddr(); addr != nil {
+		t.Fatal(addr)
+	}
+	d.mapping.Changed()
+	m.mu.Lock()
+	m.fail = false
+	m.mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	if d.ExternalAddr() == nil || !d.mapping.Changed() {
+		t.Fatal("renew")
+	}
+	if err = d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,445 @@
+// Package memnet is an in-memory udp network, it runs many DHT nodes
+// in one process with configurable latency, loss and NAT behavior.
+package memnet
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var errClosed = errors.New("memnet: use of closed connection")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "memnet: i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// QueueSize is the max packets queued in a Conn, the packets which
+// arrive at a full queue are dropped
+var QueueSize = 256
+
+// Stats is the count of packets of Network
+type Stats struct {
+	Sent int
+	// dropped by loss
+	Lost int
+	// no Conn at the address, or filtered by NAT
+	Unreachable int
+	// dropped at a full queue
+	Overflows int
+	Delivered int
+}
+
+// Network is an in-memory udp network, it is safe for concurrent use
+type Network struct {
+	mu         sync.Mutex
+	rand       *rand.Rand
+	minLatency time.Duration
+	maxLatency time.Duration
+	loss       float64
+	stats      Stats
+	// conns of public addresses
+	conns map[string]*Conn
+	nats  map[string]*NAT
+}
+
+// NewNetwork returns Network of which random loss and latency are
+// seeded with seed
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		rand:  rand.New(rand.NewSource(seed)),
+		conns: make(map[string]*Conn),
+		nats:  make(map[string]*NAT),
+	}
+}
+
+// SetLatency set the one way latency, it is uniform in [min, max]
+func (n *Network) SetLatency(min, max time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.minLatency, n.maxLatency = min, max
+}
+
+// SetLoss set the probability a packet is lost
+func (n *Network) SetLoss(p float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.loss = p
+}
+
+// Stats returns count of the packets
+func (n *Network) Stats() Stats {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.stats
+}
+
+// Listen returns Conn at a public address, a free port is chosen if
+// the port of addr is 0
+func (n *Network) Listen(addr *net.UDPAddr) (*Conn, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.nats[addr.IP.String()]; ok {
+		return nil, errors.New("memnet: address used by NAT")
+	}
+	return listen(n, nil, n.conns, addr)
+}
+
+// NewNAT returns NAT of which public address is ip
+func (n *Network) NewNAT(ip net.IP, t NATType) (*NAT, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	k := ip.String()
+	if _, ok := n.nats[k]; ok {
+		return nil, errors.New("memnet: address in use")
+	}
+	for _, c := range n.conns {
+		if c.addr.IP.Equal(ip) {
+			return nil, errors.New("memnet: address in use")
+		}
+	}
+	nat := newNAT(n, ip, t)
+	n.nats[k] = nat
+	return nat, nil
+}
+
+func listen(n *Network, nat *NAT, conns map[string]*Conn, addr *net.UDPAddr) (*Conn, error) {
+	a := &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+	if a.Port == 0 {
+		for a.Port = 10000; a.Port < 65536; a.Port++ {
+			if _, ok := conns[a.String()]; !ok {
+				break
+			}
+		}
+	}
+	if a.Port <= 0 || a.Port >= 65536 {
+		return nil, errors.New("memnet: invalid port")
+	}
+	if _, ok := conns[a.String()]; ok {
+		return nil, errors.New("memnet: address in use")
+	}
+	c := &Conn{
+		net:    n,
+		nat:    nat,
+		addr:   a,
+		queue:  make(chan packet, QueueSize),
+		closed: make(chan struct{}),
+	}
+	conns[a.String()] = c
+	return c, nil
+}
+
+func (n *Network) latency() time.Duration {
+	d := n.minLatency
+	if n.maxLatency > d {
+		d += time.Duration(n.rand.Int63n(int64(n.maxLatency - d + 1)))
+	}
+	return d
+}
+
+// send a packet of c to addr after latency
+func (n *Network) send(c *Conn, b []byte, addr *net.UDPAddr) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.stats.Sent++
+	src, lan := c.addr, (*NAT)(nil)
+	if nat := c.nat; nat != nil {
+		if _, ok := nat.conns[addr.String()]; ok {
+			lan = nat
+		} else {
+			src = nat.outbound(c.addr, addr)
+		}
+	}
+	if n.loss > 0 && n.rand.Float64() < n.loss {
+		n.stats.Lost++
+		return
+	}
+	p := packet{src, append([]byte(nil), b...)}
+	dst := &net.UDPAddr{IP: addr.IP, Port: addr.Port}
+	time.AfterFunc(n.latency(), func() {
+		n.deliver(p, dst, lan)
+	})
+}
+
+func (n *Network) deliver(p packet, addr *net.UDPAddr, lan *NAT) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var c *Conn
+	if lan != nil {
+		c = lan.conns[addr.String()]
+	} else if nat, ok := n.nats[addr.IP.String()]; ok {
+		c = nat.inbound(p.addr, addr.Port)
+	} else {
+		c = n.conns[addr.String()]
+	}
+	if c == nil {
+		n.stats.Unreachable++
+		return
+	}
+	select {
+	case c.queue <- p:
+		n.stats.Delivered++
+	default:
+		n.stats.Overflows++
+	}
+}
+
+type packet struct {
+	addr *net.UDPAddr
+	data []byte
+}
+
+// Conn is a udp connection of Network, it implements net.PacketConn
+type Conn struct {
+	net    *Network
+	nat    *NAT
+	addr   *net.UDPAddr
+	queue  chan packet
+	closed chan struct{}
+
+	mu           sync.Mutex
+	readDeadline time.Time
+}
+
+// ReadFrom reads a packet, the deadline set while it blocks takes
+// effect at the next call
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	if !deadline.IsZero() {
+		t := time.NewTimer(time.Until(deadline))
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case p := <-c.queue:
+		return copy(b, p.data), p.addr, nil
+	case <-c.closed:
+		return 0, nil, errClosed
+	case <-timeout:
+		return 0, nil, timeoutError{}
+	}
+}
+
+// WriteTo sends a packet to addr, it never blocks
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errClosed
+	default:
+	}
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("memnet: invalid address")
+	}
+	c.net.send(c, b, ua)
+	return len(b), nil
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	c.net.mu.Lock()
+	defer c.net.mu.Unlock()
+	select {
+	case <-c.closed:
+		return errClosed
+	default:
+	}
+	close(c.closed)
+	conns := c.net.conns
+	if c.nat != nil {
+		conns = c.nat.conns
+	}
+	delete(conns, c.addr.String())
+	return nil
+}
+
+// LocalAddr returns the address of Conn, it is the private address
+// if Conn is behind NAT
+func (c *Conn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline set the read deadline, writes never block
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline set the read deadline
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// SetWriteDeadline does nothing, writes never block
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// NATType is how NAT maps and filters
+type NATType int
+
+const (
+	// FullCone maps an internal address to one external port, which
+	// anyone can send to
+	FullCone NATType = iota
+	// RestrictedCone lets in the packets from the ips sent to
+	RestrictedCone
+	// PortRestrictedCone lets in the packets from the addresses sent to
+	PortRestrictedCone
+	// Symmetric maps every destination to another external port, which
+	// only the destination can send to
+	Symmetric
+)
+
+type natMapping struct {
+	// key of out
+	key     string
+	private *net.UDPAddr
+	port    int
+	// the filter of inbound packets, the last time sent to a peer
+	peers map[string]time.Time
+	time  time.Time
+}
+
+// NAT is a gateway of private Conns
+type NAT struct {
+	net     *Network
+	ip      net.IP
+	typ     NATType
+	timeout time.Duration
+	port    int
+	// conns of private addresses
+	conns map[string]*Conn
+	out   map[string]*natMapping
+	in    map[int]*natMapping
+}
+
+func newNAT(n *Network, ip net.IP, t NATType) *NAT {
+	return &NAT{
+		net:     n,
+		ip:      ip,
+		typ:     t,
+		timeout: 2 * time.Minute,
+		port:    20000,
+		conns:   make(map[string]*Conn),
+		out:     make(map[string]*natMapping),
+		in:      make(map[int]*natMapping),
+	}
+}
+
+// IP returns the public address of NAT
+func (nat *NAT) IP() net.IP {
+	return nat.ip
+}
+
+// SetTimeout set how long an idle mapping lives
+func (nat *NAT) SetTimeout(tm time.Duration) {
+	nat.net.mu.Lock()
+	defer nat.net.mu.Unlock()
+	nat.timeout = tm
+}
+
+// Listen returns Conn at a private address behind NAT
+func (nat *NAT) Listen(addr *net.UDPAddr) (*Conn, error) {
+	nat.net.mu.Lock()
+	defer nat.net.mu.Unlock()
+	return listen(nat.net, nat, nat.conns, addr)
+}
+
+// filterKey returns the key of peer in the filter of a mapping
+func (nat *NAT) filterKey(peer *net.UDPAddr) string {
+	switch nat.typ {
+	case FullCone:
+		return ""
+	case RestrictedCone:
+		return peer.IP.String()
+	}
+	return peer.String()
+}
+
+// outbound returns the external address of a packet from private to peer
+func (nat *NAT) outbound(private, peer *net.UDPAddr) *net.UDPAddr {
+	now := time.Now()
+	k := private.String()
+	if nat.typ == Symmetric {
+		k += "-" + peer.String()
+	}
+	m, ok := nat.out[k]
+	if !ok || now.Sub(m.time) > nat.timeout {
+		if ok {
+			nat.remove(m)
+		}
+		m = &natMapping{
+			key:     k,
+			private: private,
+			port:    nat.nextPort(),
+			peers:   make(map[string]time.Time),
+		}
+		nat.out[k] = m
+		nat.in[m.port] = m
+	}
+	m.time = now
+	m.peers[nat.filterKey(peer)] = now
+	return &net.UDPAddr{IP: nat.ip, Port: m.port}
+}
+
+// remove an expired mapping, its port may be reused at once
+func (nat *NAT) remove(m *natMapping) {
+	if nat.in[m.port] == m {
+		delete(nat.in, m.port)
+	}
+	if nat.out[m.key] == m {
+		delete(nat.out, m.key)
+	}
+}
+
+func (nat *NAT) nextPort() int {
+	for {
+		if nat.port++; nat.port >= 65536 {
+			nat.port = 1024
+		}
+		if _, ok := nat.in[nat.port]; !ok {
+			return nat.port
+		}
+	}
+}
+
+// inbound returns Conn a packet from peer to port goes to, nil if
+// it is filtered
+func (nat *NAT) inbound(peer *net.UDPAddr, port int) *Conn {
+	now := time.Now()
+	m, ok := nat.in[port]
+	if !ok {
+		return nil
+	}
+	if now.Sub(m.time) > nat.timeout {
+		nat.remove(m)
+		return nil
+	}
+	if t, ok := m.peers[nat.filterKey(peer)]; !ok || now.Sub(t) > nat.timeout {
+		return nil
+	}
+	return nat.conns[m.private.String()]
+}
+
+// String returns the name of NAT type
+func (t NATType) String() string {
+	switch t {
+	case FullCone:
+		return "full cone"
+	case RestrictedCone:
+		return "restricted cone"
+	case PortRestrictedCone:
+		return "port restricted cone"
+	}
+	return "symmetric"
+}
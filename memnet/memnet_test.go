@@ -0,0 +1,179 @@
+package memnet
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func addr(ip string, port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.ParseIP(ip), Port: port}
+}
+
+func testListen(t *testing.T, n *Network, ip string, port int) *Conn {
+	c, err := n.Listen(addr(ip, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// recv returns the sender of a packet, nil if none arrives in time
+func recv(c *Conn, data string) *net.UDPAddr {
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 64)
+	n, a, err := c.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != data {
+		return nil
+	}
+	return a.(*net.UDPAddr)
+}
+
+func Test_Network(t *testing.T) {
+	n := NewNetwork(1)
+	n.SetLatency(10*time.Millisecond, 20*time.Millisecond)
+	a := testListen(t, n, "1.0.0.1", 0)
+	b := testListen(t, n, "1.0.0.2", 6881)
+	if _, err := n.Listen(addr("1.0.0.2", 6881)); err == nil {
+		t.Fatal("address in use")
+	}
+
+	start := time.Now()
+	a.WriteTo([]byte("hello"), b.LocalAddr())
+	if from := recv(b, "hello"); from == nil || from.String() != a.LocalAddr().String() {
+		t.Fatal(from)
+	}
+	if d := time.Since(start); d < 10*time.Millisecond {
+		t.Fatal(d)
+	}
+
+	b.Close()
+	a.WriteTo([]byte("hello"), b.LocalAddr())
+	time.Sleep(30 * time.Millisecond)
+	if s := n.Stats(); s.Sent != 2 || s.Delivered != 1 || s.Unreachable != 1 {
+		t.Fatal(s)
+	}
+	if _, err := b.WriteTo([]byte("hello"), a.LocalAddr()); err == nil {
+		t.Fatal("closed")
+	}
+	a.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := a.ReadFrom(nil); err == nil || !err.(net.Error).Timeout() {
+		t.Fatal(err)
+	}
+}
+
+func Test_Loss(t *testing.T) {
+	n := NewNetwork(1)
+	n.SetLoss(0.5)
+	a := testListen(t, n, "1.0.0.1", 0)
+	b := testListen(t, n, "1.0.0.2", 0)
+	for i := 0; i < 200; i++ {
+		a.WriteTo([]byte("x"), b.LocalAddr())
+	}
+	if s := n.Stats(); s.Lost < 70 || s.Lost > 130 {
+		t.Fatal(s)
+	}
+}
+
+func Test_NAT(t *testing.T) {
+	for _, c := range []struct {
+		typ NATType
+		// whether the packets of another ip, another port of the same
+		// ip and the reply pass, and whether the mapping is reused
+		ip, port, reply, reuse bool
+	}{
+		{FullCone, true, true, true, true},
+		{RestrictedCone, false, true, true, true},
+		{PortRestrictedCone, false, false, true, true},
+		{Symmetric, false, false, true, false},
+	} {
+		n := NewNetwork(1)
+		nat, err := n.NewNAT(net.ParseIP("2.0.0.1"), c.typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := nat.Listen(addr("192.168.1.2", 6881))
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := testListen(t, n, "1.0.0.1", 6881)
+		a2 := testListen(t, n, "1.0.0.1", 6882)
+		b := testListen(t, n, "1.0.0.2", 6881)
+
+		p.WriteTo([]byte("hello"), a.LocalAddr())
+		ext := recv(a, "hello")
+		if ext == nil || !ext.IP.Equal(nat.IP()) {
+			t.Fatal(c.typ, ext)
+		}
+		for _, r := range []struct {
+			from *Conn
+			data string
+			pass bool
+		}{{a, "reply", c.reply}, {a2, "port", c.port}, {b, "ip", c.ip}} {
+			r.from.WriteTo([]byte(r.data), ext)
+			if (recv(p, r.data) != nil) != r.pass {
+				t.Fatal(c.typ, r.data)
+			}
+		}
+
+		p.WriteTo([]byte("hello"), b.LocalAddr())
+		if ext2 := recv(b, "hello"); ext2 == nil || (ext2.Port == ext.Port) != c.reuse {
+			t.Fatal(c.typ, ext, ext2)
+		}
+	}
+}
+
+func Test_NATTimeout(t *testing.T) {
+	n := NewNetwork(1)
+	nat, _ := n.NewNAT(net.ParseIP("2.0.0.1"), PortRestrictedCone)
+	nat.SetTimeout(20 * time.Millisecond)
+	p, _ := nat.Listen(addr("192.168.1.2", 0))
+	q, _ := nat.Listen(addr("192.168.1.3", 0))
+	a := testListen(t, n, "1.0.0.1", 0)
+
+	// hairpin in LAN
+	p.WriteTo([]byte("lan"), q.LocalAddr())
+	if from := recv(q, "lan"); from == nil || from.String() != p.LocalAddr().String() {
+		t.Fatal(from)
+	}
+
+	p.WriteTo([]byte("hello"), a.LocalAddr())
+	ext := recv(a, "hello")
+	time.Sleep(30 * time.Millisecond)
+	a.WriteTo([]byte("late"), ext)
+	if recv(p, "late") != nil {
+		t.Fatal("expired")
+	}
+}
+
+func Test_NATExpire(t *testing.T) {
+	n := NewNetwork(1)
+	nat, _ := n.NewNAT(net.ParseIP("2.0.0.1"), Symmetric)
+	nat.SetTimeout(20 * time.Millisecond)
+	p, _ := nat.Listen(addr("192.168.1.2", 0))
+	a := testListen(t, n, "1.0.0.1", 0)
+	b := testListen(t, n, "1.0.0.2", 0)
+
+	p.WriteTo([]byte("hello"), a.LocalAddr())
+	ext := recv(a, "hello")
+	time.Sleep(30 * time.Millisecond)
+	// the expired mapping is removed on the inbound packet
+	a.WriteTo([]byte("late"), ext)
+	if recv(p, "late") != nil {
+		t.Fatal("expired")
+	}
+	n.mu.Lock()
+	if len(nat.in) != 0 || len(nat.out) != 0 {
+		t.Fatal(len(nat.in), len(nat.out))
+	}
+	n.mu.Unlock()
+	// a new mapping keeps working after the old one is seen again
+	p.WriteTo([]byte("hello"), b.LocalAddr())
+	ext2 := recv(b, "hello")
+	p.WriteTo([]byte("hello"), a.LocalAddr())
+	recv(a, "hello")
+	b.WriteTo([]byte("reply"), ext2)
+	if recv(p, "reply") == nil {
+		t.Fatal(ext, ext2)
+	}
+}
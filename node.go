@@ -6,12 +6,66 @@ import (
 	"time"
 )
 
+// NodeState represent the state of a node, see BEP 5
+type NodeState int
+
+const (
+	// NodeGood has responded to us recently
+	NodeGood NodeState = iota
+	// NodeQuestionable has been silent for a while
+	NodeQuestionable
+	// NodeBad failed to respond to several queries in a row
+	NodeBad
+)
+
+func (s NodeState) String() string {
+	switch s {
+	case NodeGood:
+		return "good"
+	case NodeQuestionable:
+		return "questionable"
+	case NodeBad:
+		return "bad"
+	}
+	return fmt.Sprintf("NodeState(%d)", int(s))
+}
+
+// nodeLimits are the thresholds of node state and query timeout, the
+// nodes of a table share them
+type nodeLimits struct {
+	// how long a node stays good without activity
+	goodTimeout time.Duration
+	// how many queries in a row a node may fail before it goes bad
+	maxFails int
+	// query timeout of a node without rtt estimate, and the bounds
+	defaultTimeout time.Duration
+	minTimeout     time.Duration
+	maxTimeout     time.Duration
+}
+
+// defaultNodeLimits are the limits of a node not in a table
+var defaultNodeLimits = nodeLimits{
+	goodTimeout:    15 * time.Minute,
+	maxFails:       3,
+	defaultTimeout: 4 * time.Second,
+	minTimeout:     500 * time.Millisecond,
+	maxTimeout:     10 * time.Second,
+}
+
 // Node represent a dht node
 type Node struct {
 	id     *ID
 	addr   *net.UDPAddr
 	time   time.Time
+	reply  time.Time
+	query  time.Time
+	fails  int
 	pinged int
+	// when the pending ping was sent
+	ping   time.Time
+	srtt   time.Duration
+	rttvar time.Duration
+	limits *nodeLimits
 }
 
 // NewNode returns a node
@@ -38,12 +92,122 @@ func (n *Node) Time() time.Time {
 	return n.time
 }
 
+// ReplyTime returns last reply time
+func (n *Node) ReplyTime() time.Time {
+	return n.reply
+}
+
+// QueryTime returns last query time
+func (n *Node) QueryTime() time.Time {
+	return n.query
+}
+
+// Fails returns count of consecutive failed queries
+func (n *Node) Fails() int {
+	return n.fails
+}
+
+func (n *Node) lim() *nodeLimits {
+	if n.limits == nil {
+		return &defaultNodeLimits
+	}
+	return n.limits
+}
+
+// State returns node state
+func (n *Node) State() NodeState {
+	l := n.lim()
+	switch {
+	case n.fails >= l.maxFails:
+		return NodeBad
+	case time.Since(n.reply) < l.goodTimeout:
+		return NodeGood
+	case !n.reply.IsZero() && time.Since(n.query) < l.goodTimeout:
+		return NodeGood
+	}
+	return NodeQuestionable
+}
+
+// goodUntil returns when a good node turns questionable
+func (n *Node) goodUntil() time.Time {
+	t := n.reply
+	if !n.reply.IsZero() && n.query.After(t) {
+		t = n.query
+	}
+	return t.Add(n.lim().goodTimeout)
+}
+
 // Update contact time
 func (n *Node) Update() {
 	n.time = time.Now()
+}
+
+// Replied update reply time and reset failures
+func (n *Node) Replied() {
+	n.Update()
+	n.reply = n.time
+	n.fails = 0
 	n.pinged = 0
 }
 
+// Queried update query time
+func (n *Node) Queried() {
+	n.Update()
+	n.query = n.time
+}
+
+// pingSent record a maintenance ping
+func (n *Node) pingSent() {
+	n.pinged++
+	n.ping = time.Now()
+}
+
+// pingTimedOut returns true if the pending ping got no reply in time
+func (n *Node) pingTimedOut() bool {
+	return n.pinged > 0 && time.Since(n.ping) > n.Timeout()
+}
+
+// Fail count a failed query
+func (n *Node) Fail() {
+	n.fails++
+	n.pinged = 0
+}
+
+// RTT returns smoothed round trip time, 0 if it is unknown
+func (n *Node) RTT() time.Duration {
+	return n.srtt
+}
+
+// Timeout returns query timeout derived from rtt estimate
+func (n *Node) Timeout() time.Duration {
+	l := n.lim()
+	if n.srtt == 0 {
+		return l.defaultTimeout
+	}
+	tm := n.srtt + 4*n.rttvar
+	if tm < l.minTimeout {
+		tm = l.minTimeout
+	} else if tm > l.maxTimeout {
+		tm = l.maxTimeout
+	}
+	return tm
+}
+
+// Sample update rtt estimate, see RFC 6298
+func (n *Node) Sample(rtt time.Duration) {
+	if n.srtt == 0 {
+		n.srtt = rtt
+		n.rttvar = rtt / 2
+		return
+	}
+	diff := n.srtt - rtt
+	if diff < 0 {
+		diff = -diff
+	}
+	n.rttvar = (3*n.rttvar + diff) / 4
+	n.srtt = (7*n.srtt + rtt) / 8
+}
+
 func (n *Node) String() string {
 	return fmt.Sprintf("%v %v", n.id, n.addr)
 }
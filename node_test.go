@@ -3,6 +3,7 @@ package dht
 import (
 	"math/rand"
 	"testing"
+	"time"
 )
 
 func Benchmark_NewNode(b *testing.B) {
@@ -10,3 +11,48 @@ func Benchmark_NewNode(b *testing.B) {
 		NewNode(ZeroID, nil)
 	}
 }
+
+func Test_NodeState(t *testing.T) {
+	n := NewNode(ZeroID, nil)
+	if s := n.State(); s != NodeQuestionable {
+		t.Fatal(s)
+	}
+	n.Queried()
+	if s := n.State(); s != NodeQuestionable {
+		t.Fatal(s)
+	}
+	n.Replied()
+	if s := n.State(); s != NodeGood {
+		t.Fatal(s)
+	}
+	for i := 0; i < defaultNodeLimits.maxFails; i++ {
+		if s := n.State(); s == NodeBad {
+			t.Fatal(i, s)
+		}
+		n.Fail()
+	}
+	if s := n.State(); s != NodeBad {
+		t.Fatal(s)
+	}
+	n.Replied()
+	if s := n.State(); s != NodeGood {
+		t.Fatal(s)
+	}
+}
+
+func Test_Node_Sample(t *testing.T) {
+	n := NewNode(ZeroID, nil)
+	if n.RTT() != 0 || n.Timeout() != defaultNodeLimits.defaultTimeout {
+		t.Fatal(n.RTT(), n.Timeout())
+	}
+	for i := 0; i < 50; i++ {
+		n.Sample(100 * time.Millisecond)
+	}
+	if n.RTT() != 100*time.Millisecond || n.Timeout() != defaultNodeLimits.minTimeout {
+		t.Fatal(n.RTT(), n.Timeout())
+	}
+	n.Sample(time.Minute)
+	if n.Timeout() != defaultNodeLimits.maxTimeout {
+		t.Fatal(n.Timeout())
+	}
+}
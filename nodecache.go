@@ -0,0 +1,132 @@
+package dht
+
+import (
+	"container/list"
+	"net"
+	"time"
+)
+
+// cachePrefix is the count of id bits used to index the node cache
+const cachePrefix = 8
+
+// nodeCache keeps recently verified nodes, indexed by id prefix.
+// It is much larger than route table and seeds the lookups.
+type nodeCache struct {
+	cap   int
+	age   time.Duration
+	nodes *list.List
+	all   map[ID]*list.Element
+	index [1 << cachePrefix]map[ID]*Node
+	// limits of the new nodes, nil is the default
+	limits *nodeLimits
+}
+
+func newNodeCache(cap int, age time.Duration) *nodeCache {
+	c := &nodeCache{
+		cap:   cap,
+		age:   age,
+		nodes: list.New(),
+		all:   make(map[ID]*list.Element),
+	}
+	for i := range c.index {
+		c.index[i] = make(map[ID]*Node)
+	}
+	return c
+}
+
+func (c *nodeCache) Count() int {
+	return c.nodes.Len()
+}
+
+func (c *nodeCache) Find(id *ID) *Node {
+	if e, ok := c.all[*id]; ok {
+		return e.Value.(*Node)
+	}
+	return nil
+}
+
+// Insert a verified node, move to back if exist node,
+// an id reused from another ip is rejected
+func (c *nodeCache) Insert(id *ID, addr *net.UDPAddr) (n *Node) {
+	if e, ok := c.all[*id]; ok {
+		if n = e.Value.(*Node); !sameIP(n.addr, addr) {
+			return nil
+		}
+		n.addr = addr
+		n.Replied()
+		c.nodes.MoveToBack(e)
+		return
+	}
+	if c.cap <= 0 {
+		return
+	}
+	if c.nodes.Len() >= c.cap {
+		c.evict()
+	}
+	n = NewNode(id, addr)
+	n.limits = c.limits
+	n.Replied()
+	c.all[*id] = c.nodes.PushBack(n)
+	c.index[cacheIndex(id)][*id] = n
+	return
+}
+
+// evict remove the node failed most among the oldest ones
+func (c *nodeCache) evict() {
+	var node *Node
+	e := c.nodes.Front()
+	for i := 0; e != nil && i < 8; i++ {
+		if n := e.Value.(*Node); node == nil || n.fails > node.fails {
+			node = n
+		}
+		e = e.Next()
+	}
+	if node != nil {
+		c.Remove(node.id)
+	}
+}
+
+func (c *nodeCache) Remove(id *ID) {
+	if e, ok := c.all[*id]; ok {
+		delete(c.all, *id)
+		delete(c.index[cacheIndex(id)], *id)
+		c.nodes.Remove(e)
+	}
+}
+
+// Fail count a failed query, the node is removed once it goes bad
+func (c *nodeCache) Fail(id *ID) {
+	if n := c.Find(id); n != nil {
+		if n.Fail(); n.State() == NodeBad {
+			c.Remove(id)
+		}
+	}
+}
+
+// Expire remove the nodes not verified for a while
+func (c *nodeCache) Expire() {
+	for e := c.nodes.Front(); e != nil; e = c.nodes.Front() {
+		n := e.Value.(*Node)
+		if time.Since(n.reply) <= c.age {
+			break
+		}
+		c.Remove(n.id)
+	}
+}
+
+// Closest returns the k closest nodes to id
+func (c *nodeCache) Closest(id *ID, k int) []*Node {
+	cn := newClosestNodes(id, k)
+	// the nodes of prefix p^i are closer than the nodes of prefix p^(i+1)
+	p := cacheIndex(id)
+	for i := 0; i < len(c.index) && cn.Len() < k; i++ {
+		for _, n := range c.index[p^i] {
+			cn.Push(n)
+		}
+	}
+	return cn.Sorted()
+}
+
+func cacheIndex(id *ID) int {
+	return int(id[0]) >> (8 - cachePrefix)
+}
@@ -0,0 +1,38 @@
+package dht
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func Test_nodeCache(t *testing.T) {
+	c := newNodeCache(1000, time.Minute)
+	var ids []*ID
+	for i := 0; i < 1500; i++ {
+		id := newRandomID()
+		c.Insert(id, nil)
+		ids = append(ids, id)
+	}
+	if c.Count() != 1000 {
+		t.Fatal(c.Count())
+	}
+	ids = ids[500:]
+	for i := 0; i < 100; i++ {
+		id := newRandomID()
+		sort.Slice(ids, func(i, j int) bool {
+			return id.cmpDistance(ids[i], ids[j]) < 0
+		})
+		for j, n := range c.Closest(id, 8) {
+			if n.id != ids[j] {
+				t.Fatal(j, n.id, ids[j])
+			}
+		}
+	}
+	for i := 0; i < defaultNodeLimits.maxFails; i++ {
+		c.Fail(ids[0])
+	}
+	if c.Find(ids[0]) != nil || c.Count() != 999 {
+		t.Fatal(c.Count())
+	}
+}
@@ -0,0 +1,161 @@
+package dht
+
+import (
+	"container/list"
+	"errors"
+	"net"
+)
+
+// SendPriority of outbound packets
+type SendPriority int
+
+const (
+	// SendReply is the priority of replies
+	SendReply SendPriority = iota
+	// SendQuery is the priority of queries
+	SendQuery
+	// SendMaintenance is the priority of table maintenance
+	SendMaintenance
+)
+
+var (
+	// ErrSendDeferred is returned if a packet is queued by the pacer
+	ErrSendDeferred = errors.New("send deferred")
+	// ErrSendDropped is returned if a packet is dropped by the pacer
+	ErrSendDropped = errors.New("send dropped")
+)
+
+// SendStats counts the outbound packets
+type SendStats struct {
+	Sent     int
+	Deferred int
+	Dropped  int
+}
+
+type packet struct {
+	addr  *net.UDPAddr
+	data  []byte
+	write func(*net.UDPAddr, []byte) error
+}
+
+// pacer limits the outbound packets and bytes per second,
+// the packets over budget are queued by priority
+type pacer struct {
+	pps     float64
+	bps     float64
+	cap     int
+	packets tokenBucket
+	bytes   tokenBucket
+	queues  [SendMaintenance + 1]*list.List
+	stats   SendStats
+}
+
+func newPacer() *pacer {
+	p := &pacer{}
+	for i := range p.queues {
+		p.queues[i] = list.New()
+	}
+	return p
+}
+
+// Set the budget, 0 is unlimited
+func (p *pacer) Set(pps, bps, queue int) {
+	p.pps = float64(pps)
+	p.bps = float64(bps)
+	p.cap = queue
+	p.packets.tokens = float64(p.packetBurst())
+	p.bytes.tokens = float64(p.byteBurst())
+}
+
+// bursts allow 100ms of traffic at once
+func (p *pacer) packetBurst() int {
+	if n := int(p.pps / 10); n > 1 {
+		return n
+	}
+	return 1
+}
+
+func (p *pacer) byteBurst() int {
+	if n := int(p.bps / 10); n > 2048 {
+		return n
+	}
+	return 2048
+}
+
+func (p *pacer) Count() (n int) {
+	for _, q := range p.queues {
+		n += q.Len()
+	}
+	return
+}
+
+func (p *pacer) allow(size int) bool {
+	if p.pps > 0 {
+		if p.packets.Fill(p.pps, p.packetBurst()); p.packets.tokens < 1 {
+			return false
+		}
+	}
+	if p.bps > 0 {
+		burst := p.byteBurst()
+		p.bytes.Fill(p.bps, burst)
+		if p.bytes.tokens < float64(size) && p.bytes.tokens < float64(burst) {
+			return false
+		}
+	}
+	p.packets.tokens--
+	p.bytes.tokens -= float64(size)
+	return true
+}
+
+// Send a packet now if budget allows and no packet of higher or
+// same priority is waiting, otherwise queue it, a queued packet is
+// written by write of its own
+func (p *pacer) Send(prio SendPriority, addr *net.UDPAddr, data []byte, write func(*net.UDPAddr, []byte) error) error {
+	p.Flush()
+	waiting := false
+	for i := SendReply; i <= prio; i++ {
+		if p.queues[i].Len() > 0 {
+			waiting = true
+		}
+	}
+	if !waiting && p.allow(len(data)) {
+		p.stats.Sent++
+		return write(addr, data)
+	}
+	if p.Count() >= p.cap && !p.evict(prio) {
+		p.stats.Dropped++
+		return ErrSendDropped
+	}
+	p.queues[prio].PushBack(&packet{addr, data, write})
+	p.stats.Deferred++
+	return ErrSendDeferred
+}
+
+// evict drop the newest packet of lower priority
+func (p *pacer) evict(prio SendPriority) bool {
+	for i := SendMaintenance; i > prio; i-- {
+		if e := p.queues[i].Back(); e != nil {
+			p.queues[i].Remove(e)
+			p.stats.Dropped++
+			return true
+		}
+	}
+	return false
+}
+
+// Flush send the queued packets which fit the budget
+func (p *pacer) Flush() (n int) {
+	for _, q := range p.queues {
+		for e := q.Front(); e != nil; e = q.Front() {
+			pk := e.Value.(*packet)
+			if !p.allow(len(pk.data)) {
+				return
+			}
+			q.Remove(e)
+			p.stats.Sent++
+			pk.write(pk.addr, pk.data)
+			n++
+		}
+	}
+	return
+}
@@ -0,0 +1,45 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_pacer(t *testing.T) {
+	var sent []byte
+	write := func(addr *net.UDPAddr, data []byte) error {
+		sent = append(sent, data[0])
+		return nil
+	}
+	p := newPacer()
+	p.Set(1, 0, 2)
+	if err := p.Send(SendQuery, nil, []byte{1}, write); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Send(SendMaintenance, nil, []byte{2}, write); err != ErrSendDeferred {
+		t.Fatal(err)
+	}
+	if err := p.Send(SendQuery, nil, []byte{3}, write); err != ErrSendDeferred {
+		t.Fatal(err)
+	}
+	if err := p.Send(SendReply, nil, []byte{4}, write); err != ErrSendDeferred {
+		t.Fatal(err)
+	}
+	if err := p.Send(SendMaintenance, nil, []byte{5}, write); err != ErrSendDropped {
+		t.Fatal(err)
+	}
+	p.packets.tokens = 1
+	if n := p.Flush(); n != 1 {
+		t.Fatal(n)
+	}
+	p.packets.tokens = 1
+	if n := p.Flush(); n != 1 {
+		t.Fatal(n)
+	}
+	if string(sent) != "\x01\x04\x03" {
+		t.Fatal(sent)
+	}
+	if s := p.stats; s.Sent != 3 || s.Deferred != 3 || s.Dropped != 2 {
+		t.Fatal(s)
+	}
+}
@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"errors"
+	"net"
+)
+
+func mustParseCIDRs(cidrs ...string) (nets []*net.IPNet) {
+	for _, s := range cidrs {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+// martianNets are never valid peer addresses
+var martianNets = mustParseCIDRs(
+	"0.0.0.0/8",       // this network
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link local
+	"192.0.0.0/24",    // protocol assignments
+	"192.0.2.0/24",    // documentation
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved and broadcast
+	"::/128",          // unspecified
+	"::1/128",         // loopback
+	"100::/64",        // discard
+	"2001:db8::/32",   // documentation
+	"fe80::/10",       // link local
+	"ff00::/8",        // multicast
+)
+
+// privateNets are valid peer addresses only in LAN
+var privateNets = mustParseCIDRs(
+	"10.0.0.0/8",
+	"100.64.0.0/10", // carrier grade NAT
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7", // unique local
+)
+
+func inNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidatePeer returns error if a compact peer has a martian address
+// or port 0, the private addresses are rejected unless allowPrivate
+func ValidatePeer(peer []byte, allowPrivate bool) error {
+	var ip net.IP
+	switch len(peer) {
+	case 6:
+		ip = net.IP(peer[:4])
+	case 18:
+		ip = net.IP(peer[:16])
+	default:
+		return errors.New("invalid peer")
+	}
+	if peer[len(peer)-2] == 0 && peer[len(peer)-1] == 0 {
+		return errors.New("invalid port")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if inNets(ip, martianNets) {
+		return errors.New("martian address")
+	}
+	if !allowPrivate && inNets(ip, privateNets) {
+		return errors.New("private address")
+	}
+	return nil
+}
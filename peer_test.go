@@ -0,0 +1,43 @@
+package dht
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_ValidatePeer(t *testing.T) {
+	cases := []struct {
+		ip      string
+		port    int
+		private bool
+		ok      bool
+	}{
+		{"1.2.3.4", 6881, false, true},
+		{"1.2.3.4", 0, false, false},
+		{"0.0.0.0", 6881, false, false},
+		{"127.0.0.1", 6881, true, false},
+		{"224.0.0.1", 6881, false, false},
+		{"255.255.255.255", 6881, false, false},
+		{"192.168.1.1", 6881, false, false},
+		{"192.168.1.1", 6881, true, true},
+		{"2001:4860::1", 6881, false, true},
+		{"::1", 6881, false, false},
+		{"fd00::1", 6881, false, false},
+		{"fd00::1", 6881, true, true},
+		{"::ffff:10.0.0.1", 6881, false, false},
+	}
+	for _, c := range cases {
+		ip := net.ParseIP(c.ip)
+		peer := append([]byte(nil), ip.To16()...)
+		if ip4 := ip.To4(); ip4 != nil && c.ip[0] != ':' {
+			peer = append([]byte(nil), ip4...)
+		}
+		peer = append(peer, byte(c.port>>8), byte(c.port))
+		if err := ValidatePeer(peer, c.private); (err == nil) != c.ok {
+			t.Error(c.ip, c.port, c.private, err)
+		}
+	}
+	if ValidatePeer([]byte{1, 2, 3}, true) == nil {
+		t.Error("length")
+	}
+}
@@ -0,0 +1,85 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// NATPMP is a client of NAT-PMP gateway, see RFC 6886
+type NATPMP struct {
+	gateway string
+	timeout time.Duration
+}
+
+// NewNATPMP returns NATPMP of gateway address, e.g. "192.168.1.1:5351"
+func NewNATPMP(gateway string, timeout time.Duration) *NATPMP {
+	return &NATPMP{gateway: gateway, timeout: timeout}
+}
+
+func (p *NATPMP) probe() error {
+	_, err := p.ExternalIP()
+	return err
+}
+
+// ExternalIP returns the external address of gateway
+func (p *NATPMP) ExternalIP() (net.IP, error) {
+	resp, err := request(p.gateway, []byte{0, 0}, p.timeout, func(b []byte) bool {
+		return len(b) >= 12 && b[0] == 0 && b[1] == 128
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = resultError(int(binary.BigEndian.Uint16(resp[2:])), natpmpResults); err != nil {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+func (p *NATPMP) mapping(protocol string, internal, external int, lifetime time.Duration) (*Mapping, error) {
+	op := byte(1)
+	if n, err := protocolNumber(protocol); err != nil {
+		return nil, err
+	} else if n == 6 {
+		op = 2
+	}
+	req := make([]byte, 12)
+	req[1] = op
+	binary.BigEndian.PutUint16(req[4:], uint16(internal))
+	binary.BigEndian.PutUint16(req[6:], uint16(external))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	resp, err := request(p.gateway, req, p.timeout, func(b []byte) bool {
+		return len(b) >= 16 && b[0] == 0 && b[1] == 128+op &&
+			int(binary.BigEndian.Uint16(b[8:])) == internal
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = resultError(int(binary.BigEndian.Uint16(resp[2:])), natpmpResults); err != nil {
+		return nil, err
+	}
+	return &Mapping{
+		Protocol:     protocol,
+		InternalPort: internal,
+		ExternalPort: int(binary.BigEndian.Uint16(resp[10:])),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second,
+	}, nil
+}
+
+// AddMapping map external port to internal port for lifetime
+func (p *NATPMP) AddMapping(protocol string, internal, external int, lifetime time.Duration) (*Mapping, error) {
+	m, err := p.mapping(protocol, internal, external, lifetime)
+	if err != nil {
+		return nil, err
+	}
+	if m.ExternalIP, err = p.ExternalIP(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DeleteMapping remove a mapping
+func (p *NATPMP) DeleteMapping(m *Mapping) error {
+	_, err := p.mapping(m.Protocol, m.InternalPort, 0, 0)
+	return err
+}
@@ -0,0 +1,100 @@
+package portmap
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// PCP is a client of Port Control Protocol gateway, see RFC 6887
+type PCP struct {
+	gateway string
+	timeout time.Duration
+	// nonce identifies the mappings of this client
+	nonce [12]byte
+}
+
+// NewPCP returns PCP of gateway address, e.g. "192.168.1.1:5351"
+func NewPCP(gateway string, timeout time.Duration) *PCP {
+	p := &PCP{gateway: gateway, timeout: timeout}
+	rand.Read(p.nonce[:])
+	return p
+}
+
+// header returns the common header of requests
+func (p *PCP) header(op byte, lifetime time.Duration, size int) ([]byte, error) {
+	client, err := localIP(p.gateway)
+	if err != nil {
+		return nil, err
+	}
+	req := make([]byte, size)
+	req[0] = 2
+	req[1] = op
+	binary.BigEndian.PutUint32(req[4:], uint32(lifetime/time.Second))
+	copy(req[8:24], client.To16())
+	return req, nil
+}
+
+// probe send an ANNOUNCE request, a NAT-PMP gateway answers
+// it with unsupported version
+func (p *PCP) probe() error {
+	req, err := p.header(0, 0, 24)
+	if err != nil {
+		return err
+	}
+	resp, err := request(p.gateway, req, p.timeout, func(b []byte) bool {
+		return len(b) >= 4
+	})
+	if err != nil {
+		return err
+	}
+	if resp[0] != 2 || resp[1] != 0x80 {
+		return resultError(1, pcpResults)
+	}
+	return resultError(int(resp[3]), pcpResults)
+}
+
+func (p *PCP) mapping(protocol string, internal, external int, lifetime time.Duration) (*Mapping, error) {
+	proto, err := protocolNumber(protocol)
+	if err != nil {
+		return nil, err
+	}
+	req, err := p.header(1, lifetime, 60)
+	if err != nil {
+		return nil, err
+	}
+	copy(req[24:36], p.nonce[:])
+	req[36] = proto
+	binary.BigEndian.PutUint16(req[40:], uint16(internal))
+	binary.BigEndian.PutUint16(req[42:], uint16(external))
+	copy(req[44:60], net.IPv4zero.To16())
+	resp, err := request(p.gateway, req, p.timeout, func(b []byte) bool {
+		return len(b) >= 60 && b[0] == 2 && b[1] == 0x81 && bytes.Equal(b[24:36], p.nonce[:])
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = resultError(int(resp[3]), pcpResults); err != nil {
+		return nil, err
+	}
+	return &Mapping{
+		Protocol:     protocol,
+		InternalPort: internal,
+		ExternalIP:   net.IP(append([]byte(nil), resp[44:60]...)),
+		ExternalPort: int(binary.BigEndian.Uint16(resp[42:])),
+		Lifetime:     time.Duration(binary.BigEndian.Uint32(resp[4:])) * time.Second,
+	}, nil
+}
+
+// AddMapping map external port to internal port for lifetime
+func (p *PCP) AddMapping(protocol string, internal, external int, lifetime time.Duration) (*Mapping, error) {
+	return p.mapping(protocol, internal, external, lifetime)
+}
+
+// DeleteMapping remove a mapping
+func (p *PCP) DeleteMapping(m *Mapping) error {
+	_, err := p.mapping(m.Protocol, m.InternalPort, 0, 0)
+	return err
+}
@@ -0,0 +1,192 @@
+// Package portmap maps the ports of this host on the home gateway
+// with NAT-PMP, PCP or UPnP IGD, so that other nodes can reach it.
+package portmap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Mapping is a port mapped on gateway
+type Mapping struct {
+	// Protocol is "udp" or "tcp"
+	Protocol     string
+	InternalPort int
+	ExternalIP   net.IP
+	ExternalPort int
+	// Lifetime granted by gateway, 0 if the mapping is permanent
+	Lifetime time.Duration
+}
+
+// Mapper maps the ports of this host on gateway
+type Mapper interface {
+	// AddMapping map external port to internal port for lifetime, the
+	// external port is a suggestion and 0 lets gateway choose one
+	AddMapping(protocol string, internal, external int, lifetime time.Duration) (*Mapping, error)
+	// DeleteMapping remove a mapping
+	DeleteMapping(m *Mapping) error
+}
+
+// ErrNoGateway is returned if no gateway answers
+var ErrNoGateway = errors.New("portmap: no gateway found")
+
+// Discover returns a Mapper of the default gateway, PCP, NAT-PMP and
+// UPnP IGD are tried in order
+func Discover(timeout time.Duration) (Mapper, error) {
+	if gw, err := Gateway(); err == nil {
+		addr := net.JoinHostPort(gw.String(), "5351")
+		if p := NewPCP(addr, timeout); p.probe() == nil {
+			return p, nil
+		}
+		if p := NewNATPMP(addr, timeout); p.probe() == nil {
+			return p, nil
+		}
+	}
+	u, err := DiscoverUPnP(SSDPAddr, timeout)
+	if err != nil {
+		return nil, ErrNoGateway
+	}
+	return u, nil
+}
+
+// Gateway returns the default IPv4 gateway, it is read from the route
+// table of Linux and guessed as the .1 of local network otherwise
+func Gateway() (net.IP, error) {
+	if f, err := os.Open("/proc/net/route"); err == nil {
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for s.Scan() {
+			fields := strings.Fields(s.Text())
+			if len(fields) < 3 || fields[1] != "00000000" || len(fields[2]) != 8 {
+				continue
+			}
+			var ip [4]byte
+			for i := range ip {
+				var b byte
+				for _, c := range fields[2][2*i : 2*i+2] {
+					b = b<<4 | unhex(c)
+				}
+				ip[i] = b
+			}
+			// the gateway is little endian hex
+			return net.IPv4(ip[3], ip[2], ip[1], ip[0]), nil
+		}
+	}
+	conn, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	ip := conn.LocalAddr().(*net.UDPAddr).IP.To4()
+	if ip == nil || ip.IsLoopback() {
+		return nil, ErrNoGateway
+	}
+	return net.IPv4(ip[0], ip[1], ip[2], 1), nil
+}
+
+func unhex(c rune) byte {
+	switch {
+	case c >= '0' && c <= '9':
+		return byte(c - '0')
+	case c >= 'a' && c <= 'f':
+		return byte(c - 'a' + 10)
+	case c >= 'A' && c <= 'F':
+		return byte(c - 'A' + 10)
+	}
+	return 0
+}
+
+// localIP returns the local address used to reach addr
+func localIP(addr string) (net.IP, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// request send a request to gateway and returns the first response
+// accepted by ok, it is retried until timeout
+func request(addr string, req []byte, timeout time.Duration, ok func([]byte) bool) ([]byte, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1100)
+	// RFC 6886 retries from 250ms and doubles the interval
+	for wait := 250 * time.Millisecond; time.Now().Before(deadline); wait *= 2 {
+		if _, err = conn.Write(req); err != nil {
+			return nil, err
+		}
+		t := time.Now().Add(wait)
+		if t.After(deadline) {
+			t = deadline
+		}
+		conn.SetReadDeadline(t)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				break
+			}
+			if ok(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+	}
+	return nil, ErrNoGateway
+}
+
+func protocolNumber(protocol string) (byte, error) {
+	switch strings.ToLower(protocol) {
+	case "udp":
+		return 17, nil
+	case "tcp":
+		return 6, nil
+	}
+	return 0, errors.New("portmap: unknown protocol " + protocol)
+}
+
+// results are the names of NAT-PMP and PCP result codes
+var (
+	natpmpResults = []string{
+		1: "unsupported version",
+		2: "not authorized",
+		3: "network failure",
+		4: "out of resources",
+		5: "unsupported opcode",
+	}
+	pcpResults = []string{
+		1:  "unsupported version",
+		2:  "not authorized",
+		3:  "malformed request",
+		4:  "unsupported opcode",
+		5:  "unsupported option",
+		6:  "malformed option",
+		7:  "network failure",
+		8:  "no resources",
+		9:  "unsupported protocol",
+		10: "user exceeded quota",
+		11: "cannot provide external",
+		12: "address mismatch",
+		13: "excessive remote peers",
+	}
+)
+
+// resultError returns error of a result code
+func resultError(code int, names []string) error {
+	if code == 0 {
+		return nil
+	}
+	if code < len(names) {
+		return errors.New("portmap: " + names[code])
+	}
+	return fmt.Errorf("portmap: result code %d", code)
+}
@@ -0,0 +1,279 @@
+package portmap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var externalIP = net.IPv4(203, 0, 113, 7)
+
+// fakeGateway answers NAT-PMP, or PCP if pcp is true
+type fakeGateway struct {
+	conn     *net.UDPConn
+	pcp      bool
+	mu       sync.Mutex
+	mappings map[int]int
+}
+
+func newFakeGateway(t *testing.T, pcp bool) *fakeGateway {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &fakeGateway{conn: conn, pcp: pcp, mappings: make(map[int]int)}
+	go g.serve()
+	return g
+}
+
+func (g *fakeGateway) Addr() string {
+	return g.conn.LocalAddr().String()
+}
+
+func (g *fakeGateway) Count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.mappings)
+}
+
+func (g *fakeGateway) mapping(internal, external int, lifetime uint32) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if lifetime == 0 {
+		delete(g.mappings, internal)
+		return 0
+	}
+	if external == 0 {
+		external = 40000 + internal%1000
+	}
+	g.mappings[internal] = external
+	return external
+}
+
+func (g *fakeGateway) serve() {
+	buf := make([]byte, 1100)
+	for {
+		n, addr, err := g.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req := buf[:n]
+		var resp []byte
+		switch {
+		case req[0] == 0 && g.pcp:
+			resp = []byte{0, 128 + req[1], 0, 1}
+		case req[0] == 0 && req[1] == 0:
+			resp = make([]byte, 12)
+			resp[1] = 128
+			copy(resp[8:], externalIP.To4())
+		case req[0] == 0:
+			resp = make([]byte, 16)
+			resp[1] = 128 + req[1]
+			internal := int(binary.BigEndian.Uint16(req[4:]))
+			lifetime := binary.BigEndian.Uint32(req[8:])
+			ext := g.mapping(internal, int(binary.BigEndian.Uint16(req[6:])), lifetime)
+			binary.BigEndian.PutUint16(resp[8:], uint16(internal))
+			binary.BigEndian.PutUint16(resp[10:], uint16(ext))
+			binary.BigEndian.PutUint32(resp[12:], lifetime)
+		case req[0] == 2 && !g.pcp:
+			resp = []byte{0, 128 + req[1], 0, 1}
+		case req[0] == 2 && req[1] == 0:
+			resp = make([]byte, 24)
+			resp[0], resp[1] = 2, 0x80
+		case req[0] == 2 && req[1] == 1:
+			resp = make([]byte, 60)
+			copy(resp, req)
+			resp[1] = 0x81
+			internal := int(binary.BigEndian.Uint16(req[40:]))
+			lifetime := binary.BigEndian.Uint32(req[4:])
+			ext := g.mapping(internal, int(binary.BigEndian.Uint16(req[42:])), lifetime)
+			binary.BigEndian.PutUint16(resp[42:], uint16(ext))
+			copy(resp[44:], externalIP.To16())
+		}
+		g.conn.WriteToUDP(resp, addr)
+	}
+}
+
+func testMapper(t *testing.T, m Mapper, g interface{ Count() int }) {
+	mp, err := m.AddMapping("udp", 6881, 0, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mp.ExternalIP.Equal(externalIP) || mp.ExternalPort == 0 || mp.Lifetime != time.Hour {
+		t.Fatal(mp)
+	}
+	if g.Count() != 1 {
+		t.Fatal(g.Count())
+	}
+	if err = m.DeleteMapping(mp); err != nil {
+		t.Fatal(err)
+	}
+	if g.Count() != 0 {
+		t.Fatal(g.Count())
+	}
+}
+
+func Test_NATPMP(t *testing.T) {
+	g := newFakeGateway(t, false)
+	defer g.conn.Close()
+	p := NewNATPMP(g.Addr(), time.Second)
+	if NewPCP(g.Addr(), time.Second).probe() == nil {
+		t.Fatal("pcp")
+	}
+	if err := p.probe(); err != nil {
+		t.Fatal(err)
+	}
+	testMapper(t, p, g)
+}
+
+func Test_PCP(t *testing.T) {
+	g := newFakeGateway(t, true)
+	defer g.conn.Close()
+	p := NewPCP(g.Addr(), time.Second)
+	if err := p.probe(); err != nil {
+		t.Fatal(err)
+	}
+	testMapper(t, p, g)
+}
+
+// fakeIGD answers SSDP and SOAP of UPnP
+type fakeIGD struct {
+	ssdp *net.UDPConn
+	http *httptest.Server
+	mu   sync.Mutex
+	// leases of the external ports
+	mappings map[string]string
+	// supports only permanent leases
+	permanent bool
+}
+
+const fakeDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+<device>
+  <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+  <deviceList><device>
+    <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+    <deviceList><device>
+      <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+      <serviceList><service>
+        <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+        <controlURL>/ctl</controlURL>
+      </service></serviceList>
+    </device></deviceList>
+  </device></deviceList>
+</device>
+</root>`
+
+func newFakeIGD(t *testing.T) *fakeIGD {
+	g := &fakeIGD{mappings: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, fakeDescription)
+	})
+	mux.HandleFunc("/ctl", g.control)
+	g.http = httptest.NewServer(mux)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.ssdp = conn
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(string(buf[:n]), "M-SEARCH") {
+				resp := "HTTP/1.1 200 OK\r\nLOCATION: " + g.http.URL + "/desc.xml\r\n\r\n"
+				conn.WriteToUDP([]byte(resp), addr)
+			}
+		}
+	}()
+	return g
+}
+
+func (g *fakeIGD) Close() {
+	g.ssdp.Close()
+	g.http.Close()
+}
+
+func (g *fakeIGD) Count() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return len(g.mappings)
+}
+
+func (g *fakeIGD) control(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	action := r.Header.Get("SOAPAction")
+	action = strings.Trim(action[strings.Index(action, "#")+1:], `"`)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var result string
+	switch action {
+	case "GetExternalIPAddress":
+		result = "<NewExternalIPAddress>" + externalIP.String() + "</NewExternalIPAddress>"
+	case "AddPortMapping":
+		if xmlValue(body, "NewInternalClient") == "" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "<errorCode>402</errorCode>")
+			return
+		}
+		lease := xmlValue(body, "NewLeaseDuration")
+		if g.permanent && lease != "0" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "<errorCode>725</errorCode>")
+			return
+		}
+		g.mappings[xmlValue(body, "NewExternalPort")] = lease
+	case "GetSpecificPortMappingEntry":
+		lease, ok := g.mappings[xmlValue(body, "NewExternalPort")]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "<errorCode>714</errorCode>")
+			return
+		}
+		result = "<NewLeaseDuration>" + lease + "</NewLeaseDuration>"
+	case "DeletePortMapping":
+		if _, ok := g.mappings[xmlValue(body, "NewExternalPort")]; !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, "<errorCode>714</errorCode>")
+			return
+		}
+		delete(g.mappings, xmlValue(body, "NewExternalPort"))
+	}
+	fmt.Fprintf(w, `<s:Envelope><s:Body><u:%sResponse>%s</u:%sResponse></s:Body></s:Envelope>`, action, result, action)
+}
+
+func Test_UPnP(t *testing.T) {
+	g := newFakeIGD(t)
+	defer g.Close()
+	u, err := DiscoverUPnP(g.ssdp.LocalAddr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.control != g.http.URL+"/ctl" {
+		t.Fatal(u.control)
+	}
+	testMapper(t, u, g)
+	if err = u.DeleteMapping(&Mapping{Protocol: "udp", ExternalPort: 1}); err == nil || !strings.Contains(err.Error(), "714") {
+		t.Fatal(err)
+	}
+
+	g.mu.Lock()
+	g.permanent = true
+	g.mu.Unlock()
+	mp, err := u.AddMapping("udp", 6881, 0, time.Hour)
+	if err != nil || mp.Lifetime != 0 || g.Count() != 1 {
+		t.Fatal(mp, err)
+	}
+}
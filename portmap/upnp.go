@@ -0,0 +1,298 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSDPAddr is the multicast address of SSDP
+const SSDPAddr = "239.255.255.250:1900"
+
+// UPnP is a client of UPnP Internet Gateway Device
+type UPnP struct {
+	control string
+	service string
+	client  *http.Client
+}
+
+// DiscoverUPnP search gateway with SSDP at address ssdp, e.g. SSDPAddr
+func DiscoverUPnP(ssdp string, timeout time.Duration) (*UPnP, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", ssdp)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	for _, st := range []string{
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+		"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	} {
+		msg := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: 239.255.255.250:1900\r\n" +
+			"ST: " + st + "\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n\r\n"
+		if _, err = conn.WriteToUDP([]byte(msg), raddr); err != nil {
+			return nil, err
+		}
+	}
+	deadline := time.Now().Add(timeout)
+	conn.SetReadDeadline(deadline)
+	seen := make(map[string]bool)
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, ErrNoGateway
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		loc := resp.Header.Get("Location")
+		if loc == "" || seen[loc] {
+			continue
+		}
+		seen[loc] = true
+		// timeout is of every request of UPnP, not only of discovery
+		if u, err := NewUPnP(loc, timeout); err == nil {
+			return u, nil
+		}
+	}
+}
+
+type upnpService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+type upnpDevice struct {
+	Services []upnpService `xml:"serviceList>service"`
+	Devices  []upnpDevice  `xml:"deviceList>device"`
+}
+
+type upnpRoot struct {
+	URLBase string     `xml:"URLBase"`
+	Device  upnpDevice `xml:"device"`
+}
+
+// find returns the first WAN connection service
+func (d *upnpDevice) find() *upnpService {
+	for i, s := range d.Services {
+		if strings.Contains(s.ServiceType, ":WANIPConnection:") ||
+			strings.Contains(s.ServiceType, ":WANPPPConnection:") {
+			return &d.Services[i]
+		}
+	}
+	for i := range d.Devices {
+		if s := d.Devices[i].find(); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// NewUPnP returns UPnP of a device description url
+func NewUPnP(location string, timeout time.Duration) (*UPnP, error) {
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var root upnpRoot
+	if err = xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, err
+	}
+	s := root.Device.find()
+	if s == nil {
+		return nil, errors.New("portmap: no WAN connection service")
+	}
+	base := location
+	if root.URLBase != "" {
+		base = root.URLBase
+	}
+	b, err := url.Parse(base)
+	if err != nil {
+		return nil, err
+	}
+	c, err := url.Parse(s.ControlURL)
+	if err != nil {
+		return nil, err
+	}
+	return &UPnP{
+		control: b.ResolveReference(c).String(),
+		service: s.ServiceType,
+		client:  client,
+	}, nil
+}
+
+// soap call an action of the service, returns the response body
+func (u *UPnP) soap(action string, args ...string) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<?xml version="1.0"?>`+
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" `+
+		`s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">`+
+		`<s:Body><u:%s xmlns:u="%s">`, action, u.service)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&buf, "<%s>", args[i])
+		xml.EscapeText(&buf, []byte(args[i+1]))
+		fmt.Fprintf(&buf, "</%s>", args[i])
+	}
+	fmt.Fprintf(&buf, "</u:%s></s:Body></s:Envelope>", action)
+
+	req, err := http.NewRequest("POST", u.control, &buf)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, u.service, action))
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &upnpError{action, xmlValue(body, "errorCode"), xmlValue(body, "errorDescription")}
+	}
+	return body, nil
+}
+
+// upnpError is the fault of an action
+type upnpError struct {
+	action      string
+	code        string
+	description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("portmap: %s error %s %s", e.action, e.code, e.description)
+}
+
+// onlyPermanentLeases returns true if err is 725 OnlyPermanentLeasesSupported
+func onlyPermanentLeases(err error) bool {
+	e, ok := err.(*upnpError)
+	return ok && e.code == "725"
+}
+
+// xmlValue returns text of the first element named name
+func xmlValue(b []byte, name string) string {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		t, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		if e, ok := t.(xml.StartElement); ok && e.Name.Local == name {
+			var s string
+			d.DecodeElement(&s, &e)
+			return strings.TrimSpace(s)
+		}
+	}
+}
+
+// ExternalIP returns the external address of gateway
+func (u *UPnP) ExternalIP() (net.IP, error) {
+	body, err := u.soap("GetExternalIPAddress")
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(xmlValue(body, "NewExternalIPAddress"))
+	if ip == nil {
+		return nil, errors.New("portmap: invalid external address")
+	}
+	return ip, nil
+}
+
+// AddMapping map external port to internal port for lifetime, the
+// internal port is used if external port is 0. The mapping is
+// permanent, i.e. Lifetime is 0, if gateway supports only permanent
+// leases.
+func (u *UPnP) AddMapping(protocol string, internal, external int, lifetime time.Duration) (*Mapping, error) {
+	if _, err := protocolNumber(protocol); err != nil {
+		return nil, err
+	}
+	if external == 0 {
+		external = internal
+	}
+	c, err := url.Parse(u.control)
+	if err != nil {
+		return nil, err
+	}
+	host := c.Host
+	if c.Port() == "" {
+		host = net.JoinHostPort(c.Hostname(), "80")
+	}
+	client, err := localIP(host)
+	if err != nil {
+		return nil, err
+	}
+	lease := int(lifetime / time.Second)
+	add := func() error {
+		_, err := u.soap("AddPortMapping",
+			"NewRemoteHost", "",
+			"NewExternalPort", strconv.Itoa(external),
+			"NewProtocol", strings.ToUpper(protocol),
+			"NewInternalPort", strconv.Itoa(internal),
+			"NewInternalClient", client.String(),
+			"NewEnabled", "1",
+			"NewPortMappingDescription", "dht",
+			"NewLeaseDuration", strconv.Itoa(lease))
+		return err
+	}
+	if err = add(); onlyPermanentLeases(err) && lease != 0 {
+		lease = 0
+		err = add()
+	}
+	if err != nil {
+		return nil, err
+	}
+	// the gateway may grant another lease, keep the requested one if
+	// it can't tell
+	body, err := u.soap("GetSpecificPortMappingEntry",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(external),
+		"NewProtocol", strings.ToUpper(protocol))
+	if err == nil {
+		if n, err := strconv.Atoi(xmlValue(body, "NewLeaseDuration")); err == nil && n >= 0 {
+			lease = n
+		}
+	}
+	ip, err := u.ExternalIP()
+	if err != nil {
+		return nil, err
+	}
+	return &Mapping{
+		Protocol:     protocol,
+		InternalPort: internal,
+		ExternalIP:   ip,
+		ExternalPort: external,
+		Lifetime:     time.Duration(lease) * time.Second,
+	}, nil
+}
+
+// DeleteMapping remove a mapping
+func (u *UPnP) DeleteMapping(m *Mapping) error {
+	_, err := u.soap("DeletePortMapping",
+		"NewRemoteHost", "",
+		"NewExternalPort", strconv.Itoa(m.ExternalPort),
+		"NewProtocol", strings.ToUpper(m.Protocol))
+	return err
+}
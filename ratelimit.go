@@ -0,0 +1,204 @@
+package dht
+
+import (
+	"container/list"
+	"net"
+	"time"
+)
+
+// RateLimit configure the inbound limits of a query method,
+// a zero rate disables the limit
+type RateLimit struct {
+	// Rate and Burst limit the queries per second of an ip
+	Rate  float64
+	Burst int
+	// NetRate and NetBurst limit the queries per second of a /24 (IPv4)
+	// or /64 (IPv6) subnet
+	NetRate  float64
+	NetBurst int
+	// Reply answers the over limit queries with error 202 instead of
+	// dropping them
+	Reply bool
+}
+
+type tokenBucket struct {
+	tokens float64
+	time   time.Time
+}
+
+// Fill the tokens at rate up to burst
+func (b *tokenBucket) Fill(rate float64, burst int) {
+	now := time.Now()
+	b.tokens += rate * now.Sub(b.time).Seconds()
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.time = now
+}
+
+// Full returns true if bucket has refilled to burst
+func (b *tokenBucket) Full(rate float64, burst int) bool {
+	return b.tokens+rate*time.Since(b.time).Seconds() >= float64(burst)
+}
+
+type limitKey struct {
+	meth string
+	src  string
+}
+
+type limitBucket struct {
+	tokenBucket
+	key limitKey
+}
+
+// limitBuckets are the token buckets of sources, the least recently
+// used one is evicted for a new source if there are cap buckets
+type limitBuckets struct {
+	cap int
+	m   map[limitKey]*list.Element
+	// least recently used first
+	lru *list.List
+}
+
+func newLimitBuckets(cap int) *limitBuckets {
+	return &limitBuckets{
+		cap: cap,
+		m:   make(map[limitKey]*list.Element),
+		lru: list.New(),
+	}
+}
+
+func (bs *limitBuckets) Count() int {
+	return bs.lru.Len()
+}
+
+// Get returns the bucket of k, a new bucket is full
+func (bs *limitBuckets) Get(k limitKey, burst int) *tokenBucket {
+	if e, ok := bs.m[k]; ok {
+		bs.lru.MoveToBack(e)
+		return &e.Value.(*limitBucket).tokenBucket
+	}
+	if bs.lru.Len() >= bs.cap {
+		if e := bs.lru.Front(); e != nil {
+			bs.remove(e)
+		}
+	}
+	b := &limitBucket{tokenBucket{float64(burst), time.Now()}, k}
+	bs.m[k] = bs.lru.PushBack(b)
+	return &b.tokenBucket
+}
+
+// Expire remove the buckets which have refilled, limit returns the
+// rate and burst of a bucket. The least recently used buckets are
+// visited first until one has not refilled.
+func (bs *limitBuckets) Expire(limit func(k limitKey) (float64, int)) {
+	for e := bs.lru.Front(); e != nil; e = bs.lru.Front() {
+		b := e.Value.(*limitBucket)
+		if rate, burst := limit(b.key); !b.Full(rate, burst) {
+			return
+		}
+		bs.remove(e)
+	}
+}
+
+func (bs *limitBuckets) remove(e *list.Element) {
+	delete(bs.m, e.Value.(*limitBucket).key)
+	bs.lru.Remove(e)
+}
+
+type rateLimiter struct {
+	limits map[string]RateLimit
+	ips    *limitBuckets
+	nets   *limitBuckets
+	shed   map[string]int
+}
+
+func newRateLimiter(cap int) *rateLimiter {
+	return &rateLimiter{
+		limits: make(map[string]RateLimit),
+		ips:    newLimitBuckets(cap),
+		nets:   newLimitBuckets(cap),
+		shed:   make(map[string]int),
+	}
+}
+
+func (r *rateLimiter) Set(meth string, l RateLimit) {
+	r.limits[meth] = l
+}
+
+// Allow returns true if a query is under the limits, and whether
+// the over limit query should be answered with an error
+func (r *rateLimiter) Allow(meth string, ip net.IP) (ok bool, reply bool) {
+	l, has := r.limits[meth]
+	if !has {
+		return true, false
+	}
+	// both buckets are checked before a token is taken from either
+	var ib, nb *tokenBucket
+	ok = true
+	if l.Rate > 0 {
+		ib, ok = r.bucket(r.ips, limitKey{meth, string(ip.To16())}, l.Rate, l.Burst)
+	}
+	if ok && l.NetRate > 0 {
+		nb, ok = r.bucket(r.nets, limitKey{meth, subnet(ip)}, l.NetRate, l.NetBurst)
+	}
+	if !ok {
+		r.shed[meth]++
+		return ok, l.Reply
+	}
+	if ib != nil {
+		ib.tokens--
+	}
+	if nb != nil {
+		nb.tokens--
+	}
+	return ok, l.Reply
+}
+
+// bucket returns the refilled bucket of k and whether it has a token,
+// a burst less than 1 is 1
+func (r *rateLimiter) bucket(bs *limitBuckets, k limitKey, rate float64, burst int) (*tokenBucket, bool) {
+	burst = limitBurst(burst)
+	b := bs.Get(k, burst)
+	b.Fill(rate, burst)
+	return b, b.tokens >= 1
+}
+
+// Expire remove the buckets which have refilled
+func (r *rateLimiter) Expire() {
+	r.ips.Expire(func(k limitKey) (float64, int) {
+		l := r.limits[k.meth]
+		return l.Rate, limitBurst(l.Burst)
+	})
+	r.nets.Expire(func(k limitKey) (float64, int) {
+		l := r.limits[k.meth]
+		return l.NetRate, limitBurst(l.NetBurst)
+	})
+}
+
+func limitBurst(burst int) int {
+	if burst < 1 {
+		return 1
+	}
+	return burst
+}
+
+// Shed returns count of the over limit queries of every method
+func (r *rateLimiter) Shed() map[string]int {
+	m := make(map[string]int, len(r.shed))
+	for meth, n := range r.shed {
+		m[meth] = n
+	}
+	return m
+}
+
+// subnet returns the /24 of an IPv4 or the /64 of an IPv6 address
+func subnet(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4[:3])
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return string(ip16[:8])
+	}
+	return ""
+}
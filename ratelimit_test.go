@@ -0,0 +1,89 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_rateLimiter(t *testing.T) {
+	r := newRateLimiter(1024)
+	r.Set("get_peers", RateLimit{Rate: 0.001, Burst: 2, NetRate: 0.001, NetBurst: 3, Reply: true})
+	ip1, ip2, ip3 := net.ParseIP("1.2.3.4"), net.ParseIP("1.2.3.5"), net.ParseIP("1.2.4.5")
+	for i, want := range []bool{true, true, false} {
+		if ok, reply := r.Allow("get_peers", ip1); ok != want || !reply {
+			t.Fatal(i, ok, reply)
+		}
+	}
+	if ok, _ := r.Allow("get_peers", ip2); !ok {
+		t.Fatal(ip2)
+	}
+	if ok, _ := r.Allow("get_peers", ip2); ok {
+		t.Fatal(ip2)
+	}
+	if ok, _ := r.Allow("get_peers", ip3); !ok {
+		t.Fatal(ip3)
+	}
+	if ok, _ := r.Allow("ping", ip1); !ok {
+		t.Fatal(ip1)
+	}
+	if n := r.Shed()["get_peers"]; n != 2 {
+		t.Fatal(n)
+	}
+}
+
+func Test_rateLimiter_Full(t *testing.T) {
+	r := newRateLimiter(4)
+	r.Set("ping", RateLimit{Rate: 0.001, Burst: 1, NetRate: 0.001, NetBurst: 2})
+	for i := 0; i < 4; i++ {
+		if ok, _ := r.Allow("ping", net.IPv4(1, 2, byte(i), 1)); !ok {
+			t.Fatal(i)
+		}
+	}
+	// both maps are full, a new source evicts the least recently used
+	if ok, _ := r.Allow("ping", net.IPv4(1, 2, 9, 1)); !ok {
+		t.Fatal("full")
+	}
+	if r.ips.Count() != 4 || r.nets.Count() != 4 {
+		t.Fatal(r.ips.Count(), r.nets.Count())
+	}
+	if ok, _ := r.Allow("ping", net.IPv4(1, 2, 3, 1)); ok {
+		t.Fatal("evicted")
+	}
+
+	// a subnet rejection doesn't take the token of ip
+	r = newRateLimiter(16)
+	r.Set("ping", RateLimit{Rate: 0.001, Burst: 1, NetRate: 0.001, NetBurst: 1})
+	r.Allow("ping", net.IPv4(1, 2, 3, 1))
+	if ok, _ := r.Allow("ping", net.IPv4(1, 2, 3, 2)); ok {
+		t.Fatal("subnet")
+	}
+	if b := r.ips.Get(limitKey{"ping", string(net.IPv4(1, 2, 3, 2).To16())}, 1); b.tokens < 1 {
+		t.Fatal(b)
+	}
+
+	// a zero burst allows a query
+	r.Set("find_node", RateLimit{Rate: 1})
+	if ok, _ := r.Allow("find_node", net.IPv4(1, 2, 3, 1)); !ok {
+		t.Fatal("burst")
+	}
+}
+
+func Test_rateLimiter_Expire(t *testing.T) {
+	r := newRateLimiter(16)
+	r.Set("ping", RateLimit{Rate: 1000, Burst: 1})
+	r.Set("find_node", RateLimit{Rate: 0.001})
+	r.Allow("ping", net.IPv4(1, 2, 3, 1))
+	r.Allow("find_node", net.IPv4(1, 2, 3, 2))
+	r.Allow("ping", net.IPv4(1, 2, 3, 3))
+	time.Sleep(10 * time.Millisecond)
+	// the expiry stops at the least recently used bucket not refilled
+	if r.Expire(); r.ips.Count() != 2 {
+		t.Fatal(r.ips.Count())
+	}
+	r.Allow("find_node", net.IPv4(1, 2, 3, 2))
+	time.Sleep(10 * time.Millisecond)
+	if r.Expire(); r.ips.Count() != 1 {
+		t.Fatal(r.ips.Count())
+	}
+}
@@ -0,0 +1,163 @@
+package dht
+
+import (
+	"container/list"
+	"net"
+	"time"
+)
+
+// Reachability tells whether other nodes can reach DHT
+type Reachability int
+
+const (
+	// ReachUnknown is the state until enough traffic is seen
+	ReachUnknown Reachability = iota
+	// Reachable is the state if unsolicited queries come in
+	Reachable
+	// Firewalled is the state if only the contacted nodes query us
+	Firewalled
+)
+
+func (r Reachability) String() string {
+	switch r {
+	case Reachable:
+		return "reachable"
+	case Firewalled:
+		return "firewalled"
+	}
+	return "unknown"
+}
+
+type contact struct {
+	ip   string
+	time time.Time
+}
+
+// reachability tells unsolicited queries, which come from the nodes
+// not contacted recently, from the queries a NAT lets through
+type reachability struct {
+	cap int
+	// how long a contacted node may query us through NAT, and how long
+	// DHT stays reachable after an unsolicited query
+	timeout time.Duration
+	// the min replies in timeout without any unsolicited query to be
+	// firewalled
+	minReplies int
+	// a firewalled DHT probes, i.e. sends normal queries, for
+	// probeWindow of every probeInterval, since other nodes never
+	// query a node which sends only read only queries
+	probeInterval time.Duration
+	probeWindow   time.Duration
+
+	state       Reachability
+	start       time.Time
+	replies     int
+	unsolicited time.Time
+	firewalled  time.Time
+	contacts    map[string]*list.Element
+	lru         *list.List
+	notify      func(Reachability)
+}
+
+func newReachability(cap int) *reachability {
+	return &reachability{
+		cap:           cap,
+		timeout:       15 * time.Minute,
+		minReplies:    20,
+		probeInterval: 10 * time.Minute,
+		probeWindow:   time.Minute,
+		start:         time.Now(),
+		contacts:      make(map[string]*list.Element),
+		lru:           list.New(),
+	}
+}
+
+// Contact record a query sent to ip
+func (r *reachability) Contact(ip net.IP) {
+	k := string(ip.To16())
+	if e, ok := r.contacts[k]; ok {
+		e.Value.(*contact).time = time.Now()
+		r.lru.MoveToBack(e)
+		return
+	}
+	if r.lru.Len() >= r.cap {
+		if e := r.lru.Front(); e != nil {
+			delete(r.contacts, e.Value.(*contact).ip)
+			r.lru.Remove(e)
+		}
+	}
+	r.contacts[k] = r.lru.PushBack(&contact{k, time.Now()})
+}
+
+// Query record a query from ip
+func (r *reachability) Query(ip net.IP) {
+	if e, ok := r.contacts[string(ip.To16())]; ok {
+		if time.Since(e.Value.(*contact).time) < r.timeout {
+			return
+		}
+	}
+	r.unsolicited = time.Now()
+	r.start = r.unsolicited
+	r.replies = 0
+	r.Update()
+}
+
+// Reply record a reply
+func (r *reachability) Reply() {
+	r.replies++
+	r.Update()
+}
+
+// Reset forget the traffic seen, e.g. when the external address changes
+func (r *reachability) Reset() {
+	r.start = time.Now()
+	r.replies = 0
+	r.unsolicited = time.Time{}
+	r.Update()
+}
+
+// Update the state and notify if it changes
+func (r *reachability) Update() {
+	state := ReachUnknown
+	switch {
+	case !r.unsolicited.IsZero() && time.Since(r.unsolicited) < r.timeout:
+		state = Reachable
+	case time.Since(r.start) >= r.timeout && r.replies >= r.minReplies:
+		state = Firewalled
+	}
+	if state != r.state {
+		r.state = state
+		if state == Firewalled {
+			r.firewalled = time.Now()
+		}
+		if r.notify != nil {
+			r.notify(state)
+		}
+	}
+}
+
+// ReadOnly returns true if the queries are read only, that is when
+// DHT is firewalled and not probing. A probe is the last probeWindow
+// of every probeInterval.
+func (r *reachability) ReadOnly() bool {
+	if r.state != Firewalled {
+		return false
+	}
+	if r.probeInterval <= 0 {
+		return true
+	}
+	return time.Since(r.firewalled)%r.probeInterval < r.probeInterval-r.probeWindow
+}
+
+// Expire remove the contacts older than timeout
+func (r *reachability) Expire() {
+	for e := r.lru.Front(); e != nil; e = r.lru.Front() {
+		c := e.Value.(*contact)
+		if time.Since(c.time) < r.timeout {
+			break
+		}
+		delete(r.contacts, c.ip)
+		r.lru.Remove(e)
+	}
+	r.Update()
+}
@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_reachability(t *testing.T) {
+	var states []Reachability
+	r := newReachability(16)
+	r.notify = func(s Reachability) {
+		states = append(states, s)
+	}
+	ip := net.ParseIP("1.2.3.4")
+	r.Contact(ip)
+	r.Query(ip)
+	if r.state != ReachUnknown {
+		t.Fatal(r.state)
+	}
+	r.start = time.Now().Add(-r.timeout)
+	for i := 0; i < r.minReplies; i++ {
+		r.Reply()
+	}
+	if r.state != Firewalled {
+		t.Fatal(r.state)
+	}
+	r.Query(net.ParseIP("1.2.3.5"))
+	if r.state != Reachable {
+		t.Fatal(r.state)
+	}
+	r.Reset()
+	if len(states) != 3 || states[2] != ReachUnknown {
+		t.Fatal(states)
+	}
+
+	r.contacts[string(ip.To16())].Value.(*contact).time = time.Now().Add(-r.timeout)
+	r.Expire()
+	if len(r.contacts) != 0 {
+		t.Fatal(len(r.contacts))
+	}
+}
+
+func Test_reachability_Probe(t *testing.T) {
+	r := newReachability(16)
+	r.start = time.Now().Add(-r.timeout)
+	for i := 0; i < r.minReplies; i++ {
+		r.Reply()
+	}
+	if r.state != Firewalled || !r.ReadOnly() {
+		t.Fatal(r.state)
+	}
+	// probing, the queries are normal
+	r.firewalled = time.Now().Add(-r.probeInterval + r.probeWindow/2)
+	if r.ReadOnly() {
+		t.Fatal("probe")
+	}
+	// a node learnt of us in the probe queries us
+	r.Query(net.ParseIP("1.2.3.4"))
+	if r.state != Reachable || r.ReadOnly() {
+		t.Fatal(r.state)
+	}
+}
+
+func Test_DHT_SetReachProbe(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	d := NewDHT(newRandomID(), conn, 8)
+	d.SetReachLimits(time.Minute, 1)
+	d.SetReachProbe(0, 0)
+	d.reach.start = time.Now().Add(-time.Minute)
+	d.reach.Reply()
+	if d.Reachability() != Firewalled || !d.reach.ReadOnly() {
+		t.Fatal(d.Reachability())
+	}
+}
@@ -0,0 +1,88 @@
+package dht
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplySize is the default max size of replies, it fits in
+// the usual MTU after the IP and UDP headers
+const DefaultReplySize = 1400
+
+// bencodeLen returns encoded length of a string of n bytes
+func bencodeLen(n int) int {
+	return len(strconv.Itoa(n)) + 1 + n
+}
+
+// replyBuilder adds values and nodes to a reply as long as the
+// encoded reply fits in size
+type replyBuilder struct {
+	size int
+	n    int
+	data map[string]interface{}
+}
+
+func newReplyBuilder(size int, tid []byte, data map[string]interface{}) *replyBuilder {
+	b, _ := encodeMessage(newReplyMessage(tid, data))
+	return &replyBuilder{size: size, n: len(b), data: data}
+}
+
+// Values add the peers in order until the reply is full,
+// returns count of the added peers
+func (b *replyBuilder) Values(peers [][]byte) int {
+	n := b.n + bencodeLen(len("values")) + len("le")
+	var values [][]byte
+	for _, p := range peers {
+		if n+bencodeLen(len(p)) > b.size {
+			break
+		}
+		values = append(values, p)
+		n += bencodeLen(len(p))
+	}
+	if len(values) > 0 {
+		b.data["values"] = values
+		b.n = n
+	}
+	return len(values)
+}
+
+// Nodes add the compact nodes in order until the reply is full,
+// returns count of the added nodes
+func (b *replyBuilder) Nodes(nodes []byte) int {
+	n := b.size - b.n - bencodeLen(len("nodes"))
+	k := len(nodes) / 26
+	for ; k > 0 && bencodeLen(26*k) > n; k-- {
+	}
+	if k > 0 {
+		b.data["nodes"] = nodes[:26*k]
+		b.n += bencodeLen(len("nodes")) + bencodeLen(26*k)
+	}
+	return k
+}
+
+// shufflePeers shuffle the peers randomly, a peer near the front is
+// more likely to stay near the front
+func shufflePeers(peers [][]byte) {
+	n := len(peers)
+	keys := make([]float64, n)
+	for i := range keys {
+		// weighted random sampling, the weight of i-th peer is n-i
+		keys[i] = math.Pow(rand.Float64(), 1/float64(n-i))
+	}
+	sort.Sort(&weightedPeers{peers, keys})
+}
+
+type weightedPeers struct {
+	peers [][]byte
+	keys  []float64
+}
+
+func (w *weightedPeers) Len() int           { return len(w.peers) }
+func (w *weightedPeers) Less(i, j int) bool { return w.keys[i] > w.keys[j] }
+
+func (w *weightedPeers) Swap(i, j int) {
+	w.peers[i], w.peers[j] = w.peers[j], w.peers[i]
+	w.keys[i], w.keys[j] = w.keys[j], w.keys[i]
+}
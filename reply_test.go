@@ -0,0 +1,53 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func Test_replyBuilder(t *testing.T) {
+	tid := []byte("aa")
+	data := map[string]interface{}{
+		"id":    newRandomID().Bytes(),
+		"token": make([]byte, tokenLen),
+	}
+	b := newReplyBuilder(200, tid, data)
+	var peers [][]byte
+	for i := 0; i < 100; i++ {
+		peers = append(peers, createPeer(net.IPv4(1, 2, 3, byte(i)), 6881))
+	}
+	n := b.Values(peers)
+	k := b.Nodes(make([]byte, 26*8))
+	if n == 0 || n == len(peers) {
+		t.Fatal(n)
+	}
+	msg, _ := encodeMessage(newReplyMessage(tid, data))
+	if len(msg) > 200 || len(msg) != b.n {
+		t.Fatal(len(msg), b.n, n, k)
+	}
+	if k > 0 && len(msg)+26 <= 200 {
+		t.Fatal(k)
+	}
+}
+
+func Test_shufflePeers(t *testing.T) {
+	var front int
+	for i := 0; i < 1000; i++ {
+		var peers [][]byte
+		for j := 0; j < 10; j++ {
+			peers = append(peers, []byte{byte(j)})
+		}
+		shufflePeers(peers)
+		if len(peers) != 10 {
+			t.Fatal(len(peers))
+		}
+		if bytes.Compare(peers[0], []byte{5}) < 0 {
+			front++
+		}
+	}
+	// the 5 most recent peers have 40 of 55 weights
+	if front < 600 {
+		t.Fatal(front)
+	}
+}
@@ -3,6 +3,7 @@ package dht
 import (
 	"math"
 	"net"
+	"sort"
 	"time"
 )
 
@@ -10,22 +11,38 @@ import (
 type CallBack func(tor *ID, peer []byte)
 
 type node struct {
-	id    *ID
-	addr  *net.UDPAddr
-	time  time.Time
-	acked bool
+	id      *ID
+	addr    *net.UDPAddr
+	time    time.Time
+	timeout time.Duration
+	path    int
+	acked   bool
+}
+
+// Expired returns true if node didn't answer in time
+func (n *node) Expired() bool {
+	return !n.acked && time.Since(n.time) > n.timeout
 }
 
+// search looks up tor along one or more disjoint paths,
+// a node belongs to only one path
 type search struct {
 	tor   *ID
 	cb    CallBack
+	time  time.Time
+	paths []int
 	nodes map[ID]*node
 }
 
-func newSearch(tor *ID, cb CallBack) *search {
+func newSearch(tor *ID, cb CallBack, paths int) *search {
+	if paths < 1 {
+		paths = 1
+	}
 	return &search{
 		tor:   tor,
 		cb:    cb,
+		time:  time.Now(),
+		paths: make([]int, paths),
 		nodes: make(map[ID]*node),
 	}
 }
@@ -34,6 +51,16 @@ func (s *search) Count() int {
 	return len(s.nodes)
 }
 
+// NumPaths returns count of paths
+func (s *search) NumPaths() int {
+	return len(s.paths)
+}
+
+// PathCount returns count of nodes of a path
+func (s *search) PathCount(path int) int {
+	return s.paths[path]
+}
+
 func (s *search) Get(id *ID) *node {
 	if n, ok := s.nodes[*id]; ok {
 		return n
@@ -41,21 +68,87 @@ func (s *search) Get(id *ID) *node {
 	return nil
 }
 
-func (s *search) Insert(id *ID, addr *net.UDPAddr) (n *node) {
+// Insert a node into path, returns the exist node of any path
+func (s *search) Insert(id *ID, addr *net.UDPAddr, timeout time.Duration, path int) (n *node) {
 	n, ok := s.nodes[*id]
 	if !ok {
 		n = &node{
-			id:   id,
-			addr: addr,
-			time: time.Now(),
+			id:      id,
+			addr:    addr,
+			time:    time.Now(),
+			timeout: timeout,
+			path:    path,
 		}
 		s.nodes[*id] = n
+		s.paths[path]++
 	}
 	return
 }
 
 func (s *search) Remove(id *ID) {
-	delete(s.nodes, *id)
+	if n, ok := s.nodes[*id]; ok {
+		s.paths[n.path]--
+		delete(s.nodes, *id)
+	}
+}
+
+// Closer returns true if id is closer than the k-th closest answered
+// node of a path, or the path has fewer answered nodes
+func (s *search) Closer(id *ID, path, k int) bool {
+	var ns []*node
+	for _, n := range s.nodes {
+		if n.path == path && n.acked {
+			ns = append(ns, n)
+		}
+	}
+	if len(ns) < k {
+		return true
+	}
+	sort.Slice(ns, func(i, j int) bool {
+		return s.tor.cmpDistance(ns[i].id, ns[j].id) < 0
+	})
+	return s.tor.cmpDistance(id, ns[k-1].id) < 0
+}
+
+// Closest returns the union of the k closest answered nodes of every path
+func (s *search) Closest(k int) []*node {
+	paths := make([][]*node, len(s.paths))
+	s.Map(func(n *node) bool {
+		if n.acked {
+			paths[n.path] = append(paths[n.path], n)
+		}
+		return true
+	})
+	var nodes []*node
+	for _, ns := range paths {
+		sort.Slice(ns, func(i, j int) bool {
+			return s.tor.cmpDistance(ns[i].id, ns[j].id) < 0
+		})
+		if len(ns) > k {
+			ns = ns[:k]
+		}
+		nodes = append(nodes, ns...)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return s.tor.cmpDistance(nodes[i].id, nodes[j].id) < 0
+	})
+	return nodes
+}
+
+// Deadline returns when the search is done without more replies,
+// d is the max duration of search
+func (s *search) Deadline(d time.Duration) time.Time {
+	t := s.time.Add(d)
+	var last time.Time
+	for _, n := range s.nodes {
+		if e := n.time.Add(n.timeout); !n.acked && e.After(last) {
+			last = e
+		}
+	}
+	if d == 0 || !last.IsZero() && last.Before(t) {
+		return last
+	}
+	return t
 }
 
 func (s *search) Notify(tor *ID, peer []byte) {
@@ -64,10 +157,16 @@ func (s *search) Notify(tor *ID, peer []byte) {
 	}
 }
 
+// Done returns true if every node answered or timed out,
+// or the search is older than d
 func (s *search) Done(d time.Duration) (done bool) {
+	if d != 0 && time.Since(s.time) > d {
+		return true
+	}
+	done = true
 	s.Map(func(n *node) bool {
-		if n.acked || (d != 0 && time.Since(n.time) > d) {
-			done = true
+		if !n.acked && !n.Expired() {
+			done = false
 		}
 		return done
 	})
@@ -134,9 +233,9 @@ func (s *searches) nextTID() int16 {
 	return -1
 }
 
-func (s *searches) Insert(tor *ID, cb CallBack) (tid int16, sr *search) {
+func (s *searches) Insert(tor *ID, cb CallBack, paths int) (tid int16, sr *search) {
 	if tid = s.nextTID(); tid != -1 {
-		sr = newSearch(tor, cb)
+		sr = newSearch(tor, cb, paths)
 		s.ss[tid] = sr
 	}
 	return
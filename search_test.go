@@ -3,12 +3,13 @@ package dht
 import (
 	"math"
 	"testing"
+	"time"
 )
 
 func Test_search(t *testing.T) {
 	s := newSearches()
 	for i := int16(0); i <= math.MaxInt16; i++ {
-		if id, _ := s.Insert(nil, nil); id != i {
+		if id, _ := s.Insert(nil, nil, 1); id != i {
 			t.Error(id, i)
 			break
 		}
@@ -17,3 +18,55 @@ func Test_search(t *testing.T) {
 		}
 	}
 }
+
+func Test_search_Closest(t *testing.T) {
+	s := newSearch(newRandomID(), nil, 2)
+	for i := 0; i < 20; i++ {
+		n := s.Insert(newRandomID(), nil, 0, i%2)
+		n.acked = i < 16
+	}
+	if s.PathCount(0) != 10 || s.PathCount(1) != 10 {
+		t.Fatal(s.PathCount(0), s.PathCount(1))
+	}
+	nodes := s.Closest(3)
+	if len(nodes) != 6 {
+		t.Fatal(len(nodes))
+	}
+	var paths [2]int
+	for _, n := range nodes {
+		paths[n.path]++
+	}
+	if paths[0] != 3 || paths[1] != 3 {
+		t.Fatal(paths)
+	}
+}
+
+func Test_search_Deadline(t *testing.T) {
+	s := newSearch(newRandomID(), nil, 1)
+	s.Insert(newRandomID(), nil, time.Second, 0)
+	s.Insert(newRandomID(), nil, 2*time.Second, 0).acked = true
+	if d := s.Deadline(time.Minute).Sub(s.time); d < time.Second || d > 2*time.Second {
+		t.Fatal(d)
+	}
+	if d := s.Deadline(time.Millisecond).Sub(s.time); d != time.Millisecond {
+		t.Fatal(d)
+	}
+}
+
+func Test_search_Closer(t *testing.T) {
+	s := newSearch(newRandomID(), nil, 2)
+	for i := 0; i < 10; i++ {
+		s.Insert(newRandomID(), nil, 0, 0).acked = i < 3
+	}
+	far := *s.tor
+	for i := range far {
+		far[i] ^= 0xff
+	}
+	if !s.Closer(newRandomID(), 0, 4) || s.Closer(&far, 0, 3) {
+		t.Fatal("closer")
+	}
+	near := s.Closest(3)
+	if !s.Closer(s.tor, 0, 3) || s.Closer(near[2].id, 0, 3) {
+		t.Fatal("near")
+	}
+}
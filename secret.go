@@ -1,57 +1,95 @@
 package dht
 
 import (
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha1"
-	"math/rand"
 	"time"
 )
 
+// tokenLen is the length of tokens, a truncated HMAC-SHA1
+const tokenLen = 8
+
+// secret creates and matches tokens with keys from crypto/rand,
+// the keys rotate every interval and the previous keep keys are
+// still accepted
 type secret struct {
-	cur  []byte
-	old  []byte
-	rand *rand.Rand
+	keys     [][]byte
+	keep     int
+	interval time.Duration
+	time     time.Time
+}
+
+func newSecret() *secret {
+	s := &secret{
+		keep:     1,
+		interval: 5 * time.Minute,
+		time:     time.Now(),
+	}
+	s.keys = [][]byte{newKey()}
+	return s
 }
 
-func newSecret() (s *secret) {
-	s = &secret{
-		cur:  make([]byte, 8),
-		old:  make([]byte, 8),
-		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+func newKey() []byte {
+	key := make([]byte, sha1.Size)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return key
+}
+
+// Set rotation interval and count of previous keys accepted, a
+// negative keep is 0
+func (s *secret) Set(interval time.Duration, keep int) {
+	if keep < 0 {
+		keep = 0
+	}
+	s.interval = interval
+	s.keep = keep
+	if len(s.keys) > keep+1 {
+		s.keys = s.keys[:keep+1]
 	}
-	s.rand.Read(s.cur)
-	copy(s.old, s.cur)
-	return
 }
 
+// Update rotate the keys
 func (s *secret) Update() {
-	copy(s.old, s.cur)
-	s.rand.Read(s.cur)
+	s.keys = append([][]byte{newKey()}, s.keys...)
+	if len(s.keys) > s.keep+1 {
+		s.keys = s.keys[:s.keep+1]
+	}
+	s.time = time.Now()
+}
+
+func (s *secret) rotate() {
+	if s.interval <= 0 {
+		return
+	}
+	n := int(time.Since(s.time) / s.interval)
+	if n > s.keep+1 {
+		n = s.keep + 1
+	}
+	for i := 0; i < n; i++ {
+		s.Update()
+	}
 }
 
 func (s *secret) Create(b []byte) []byte {
-	return s.create(b, false)
+	s.rotate()
+	return s.create(s.keys[0], b)
 }
 
-func (s *secret) create(b []byte, old bool) []byte {
-	sec := s.cur
-	if old {
-		sec = s.old
-	}
-	h := sha1.New()
-	h.Write(sec)
+func (s *secret) create(key, b []byte) []byte {
+	h := hmac.New(sha1.New, key)
 	h.Write(b)
-	return h.Sum(nil)
+	return h.Sum(nil)[:tokenLen]
 }
 
 func (s *secret) Match(b, token []byte) bool {
-	t := string(token)
-	t1 := s.create(b, false)
-	if string(t1) == t {
-		return true
-	}
-	t2 := s.create(b, true)
-	if string(t2) == t {
-		return true
+	s.rotate()
+	for _, key := range s.keys {
+		if hmac.Equal(s.create(key, b), token) {
+			return true
+		}
 	}
 	return false
 }
@@ -3,6 +3,7 @@ package dht
 import (
 	"math/rand"
 	"testing"
+	"time"
 )
 
 func Test_secret(t *testing.T) {
@@ -20,3 +21,36 @@ func Test_secret(t *testing.T) {
 func matchToken(s *secret, addr []byte) bool {
 	return s.Match(addr, s.Create(addr))
 }
+
+func Test_secret_rotate(t *testing.T) {
+	s := newSecret()
+	s.Set(time.Hour, 2)
+	addr := []byte("1.2.3.4")
+	token := s.Create(addr)
+	if len(token) != tokenLen || s.Match([]byte("1.2.3.5"), token) {
+		t.Fatal(token)
+	}
+	for i := 0; i < 2; i++ {
+		s.time = s.time.Add(-time.Hour)
+		if !s.Match(addr, token) {
+			t.Fatal(i)
+		}
+	}
+	s.time = s.time.Add(-time.Hour)
+	if s.Match(addr, token) {
+		t.Fatal(token)
+	}
+}
+
+func Test_secret_SetNegative(t *testing.T) {
+	s := newSecret()
+	s.Set(time.Hour, -1)
+	addr := []byte("1.2.3.4")
+	if !matchToken(s, addr) {
+		t.Fatal(s.keep)
+	}
+	s.time = s.time.Add(-time.Hour)
+	if s.Update(); !matchToken(s, addr) || len(s.keys) != 1 {
+		t.Fatal(len(s.keys))
+	}
+}
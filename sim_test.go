@@ -0,0 +1,315 @@
+package dht
+
+import (
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/4396/dht/memnet"
+)
+
+// simNode runs a DHT on memnet, the DHT is used under mu
+type simNode struct {
+	mu     sync.Mutex
+	d      *DHT
+	id     *ID
+	conn   *memnet.Conn
+	public bool
+	// count of the packets handled by all nodes
+	handled *int64
+}
+
+func newSimNode(conn *memnet.Conn, public bool, handled *int64) *simNode {
+	id := newRandomID()
+	s := &simNode{d: NewDHT(id, conn, 8), id: id, conn: conn, public: public, handled: handled}
+	go s.run()
+	return s
+}
+
+func (s *simNode) run() {
+	t := NewTracker(nil, nil, nil)
+	buf := make([]byte, 2048)
+	go func() {
+		for {
+			time.Sleep(100 * time.Millisecond)
+			s.mu.Lock()
+			if s.d == nil {
+				s.mu.Unlock()
+				return
+			}
+			s.d.DoTimer(15*time.Minute, time.Hour, 10*time.Second)
+			s.mu.Unlock()
+		}
+	}()
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			s.mu.Lock()
+			s.d = nil
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Lock()
+		s.d.HandleMessage(addr.(*net.UDPAddr), buf[:n], t)
+		s.mu.Unlock()
+		atomic.AddInt64(s.handled, 1)
+	}
+}
+
+func (s *simNode) do(f func(d *DHT)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.d != nil {
+		f(s.d)
+	}
+}
+
+// search returns the peers found and the closest nodes answered
+func (s *simNode) search(tor *ID) (peers [][]byte, closest []*Node) {
+	done := make(chan struct{})
+	var tid int16
+	var err error
+	s.do(func(d *DHT) {
+		tid, err = d.Search(tor, func(tor *ID, peer []byte) {
+			if peer != nil {
+				peers = append(peers, peer)
+				return
+			}
+			closest = d.SearchClosest(tid)
+			close(done)
+		})
+	})
+	if err != nil {
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(20 * time.Second):
+	}
+	return
+}
+
+// simIP returns a public ip, the ips are in distinct /24 subnets
+func simIP(i int) net.IP {
+	return net.IPv4(11, byte(i>>8), byte(i), 1)
+}
+
+// sim is the nodes of a network
+type sim struct {
+	net     *memnet.Network
+	nodes   []*simNode
+	handled int64
+}
+
+// newSim returns count nodes of which every k-th node is behind a NAT
+// of type typ if k > 0, the nodes are bootstrapped from each other
+func newSim(t *testing.T, n *memnet.Network, count, k int, typ memnet.NATType) *sim {
+	r := rand.New(rand.NewSource(1))
+	sm := &sim{net: n, nodes: make([]*simNode, count)}
+	for i := range sm.nodes {
+		var conn *memnet.Conn
+		var err error
+		public := k <= 0 || i%k != k-1
+		if !public {
+			var nat *memnet.NAT
+			if nat, err = n.NewNAT(simIP(i), typ); err == nil {
+				conn, err = nat.Listen(&net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 6881})
+			}
+		} else {
+			conn, err = n.Listen(&net.UDPAddr{IP: simIP(i), Port: 6881})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sm.nodes[i] = newSimNode(conn, public, &sm.handled)
+	}
+	for i, s := range sm.nodes[1:] {
+		for j := 0; j < 3; j++ {
+			addr := &net.UDPAddr{IP: simIP(r.Intn(i + 1)), Port: 6881}
+			s.do(func(d *DHT) { d.Ping(addr) })
+		}
+	}
+	for round := 0; round < 4; round++ {
+		sm.wait()
+		for _, s := range sm.nodes {
+			s.do(func(d *DHT) {
+				d.FindNode(d.ID())
+				d.FindNode(newRandomID())
+			})
+		}
+	}
+	sm.wait()
+	return sm
+}
+
+// wait until every packet sent is dropped or handled, it gives up
+// after a minute
+func (sm *sim) wait() {
+	for deadline := time.Now().Add(time.Minute); time.Now().Before(deadline); {
+		st := sm.net.Stats()
+		if int64(st.Sent-st.Lost-st.Unreachable-st.Overflows) == atomic.LoadInt64(&sm.handled) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (sm *sim) Close() {
+	for _, s := range sm.nodes {
+		s.conn.Close()
+	}
+}
+
+// trueClosest returns the ids of the k closest public nodes to id
+func trueClosest(nodes []*simNode, id *ID, k int) map[ID]bool {
+	var ids []*ID
+	for _, s := range nodes {
+		if s.public {
+			ids = append(ids, s.id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return id.cmpDistance(ids[i], ids[j]) < 0
+	})
+	m := make(map[ID]bool)
+	for _, id := range ids[:k] {
+		m[*id] = true
+	}
+	return m
+}
+
+// announce announces tor with port at the closest nodes, it sends from
+// the ip of s, since a token is bound to the ip
+func announce(t *testing.T, n *memnet.Network, s *simNode, tor *ID, port int) int {
+	_, closest := s.search(tor)
+	ip := s.conn.LocalAddr().(*net.UDPAddr).IP
+	conn, err := n.Listen(&net.UDPAddr{IP: ip, Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	id := newRandomID()
+	query := func(addr *net.UDPAddr, q string, data map[string]interface{}) *kadMessage {
+		data["id"] = id.Bytes()
+		msg := newQueryMessage([]byte("aa"), q, data)
+		msg.RO = 1
+		b, _ := encodeMessage(msg)
+		conn.WriteTo(b, addr)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				return nil
+			}
+			var m kadMessage
+			if from.String() == addr.String() && decodeMessage(buf[:n], &m) == nil {
+				return &m
+			}
+		}
+	}
+	stored := 0
+	for _, node := range closest {
+		m := query(node.addr, "get_peers", map[string]interface{}{"info_hash": tor.Bytes()})
+		if m == nil || m.R.Token == nil {
+			continue
+		}
+		m = query(node.addr, "announce_peer", map[string]interface{}{
+			"info_hash": tor.Bytes(),
+			"port":      port,
+			"token":     m.R.Token,
+		})
+		if m != nil && m.Y == "r" {
+			stored++
+		}
+	}
+	return stored
+}
+
+func simSize() int {
+	if testing.Short() {
+		return 100
+	}
+	return 300
+}
+
+func Test_SimSearch(t *testing.T) {
+	testSimSearch(t, simSize())
+}
+
+// Test_SimSearchLarge takes about a minute, it runs only if the
+// environment variable DHT_SIM_LARGE is set
+func Test_SimSearchLarge(t *testing.T) {
+	if os.Getenv("DHT_SIM_LARGE") == "" {
+		t.Skip("large simulation, set DHT_SIM_LARGE to run it")
+	}
+	testSimSearch(t, 2000)
+}
+
+func testSimSearch(t *testing.T, size int) {
+	n := memnet.NewNetwork(1)
+	n.SetLatency(time.Millisecond, 10*time.Millisecond)
+	n.SetLoss(0.01)
+	sm := newSim(t, n, size, 10, memnet.PortRestrictedCone)
+	defer sm.Close()
+	nodes := sm.nodes
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	found := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		// searching from behind NAT as well
+		go func(s *simNode, tor *ID) {
+			defer wg.Done()
+			_, closest := s.search(tor)
+			want := trueClosest(nodes, tor, 8)
+			mu.Lock()
+			defer mu.Unlock()
+			for _, node := range closest {
+				if want[*node.ID()] {
+					found++
+				}
+			}
+		}(nodes[i*7%len(nodes)], newRandomID())
+	}
+	wg.Wait()
+	// most of the true closest nodes are found
+	if found < 60 {
+		t.Fatal(found, n.Stats())
+	}
+}
+
+func Test_SimAnnounce(t *testing.T) {
+	n := memnet.NewNetwork(2)
+	n.SetLatency(time.Millisecond, 10*time.Millisecond)
+	sm := newSim(t, n, simSize(), 0, 0)
+	defer sm.Close()
+	nodes := sm.nodes
+
+	tor := newRandomID()
+	if stored := announce(t, n, nodes[1], tor, 7000); stored < 4 {
+		t.Fatal(stored)
+	}
+	want := string(createPeer(simIP(1), 7000))
+
+	// a third of nodes leave
+	r := rand.New(rand.NewSource(2))
+	for _, i := range r.Perm(len(nodes))[:len(nodes)/3] {
+		if i != 2 {
+			nodes[i].conn.Close()
+		}
+	}
+	peers, _ := nodes[2].search(tor)
+	for _, peer := range peers {
+		if string(peer) == want {
+			return
+		}
+	}
+	t.Fatal(peers)
+}
@@ -0,0 +1,397 @@
+// Package socks5 sends udp packets through a SOCKS5 proxy with UDP
+// ASSOCIATE, see RFC 1928 and RFC 1929.
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// ReconnectDelay is the delay before reconnecting to proxy after
+	// the control connection drops, it doubles up to MaxReconnectDelay
+	ReconnectDelay = time.Second
+	// MaxReconnectDelay is the max delay of reconnecting
+	MaxReconnectDelay = time.Minute
+	// DialTimeout is the timeout of connecting and negotiating with proxy
+	DialTimeout = 10 * time.Second
+)
+
+var errClosed = errors.New("socks5: use of closed connection")
+
+// keepAlivePeriod is the keepalive of the control connection, so that
+// a dead proxy or a dropped NAT mapping is noticed
+const keepAlivePeriod = 30 * time.Second
+
+// Addr is the address of relay, it is not a *net.UDPAddr since it is
+// not bound locally, and other nodes may see another address if proxy
+// is behind NAT
+type Addr struct {
+	net.UDPAddr
+}
+
+// Network returns "socks5"
+func (a *Addr) Network() string {
+	return "socks5"
+}
+
+// Auth is the username and password of proxy
+type Auth struct {
+	User     string
+	Password string
+}
+
+// Conn is a net.PacketConn of which packets are relayed by proxy, it
+// reconnects to proxy if the control connection drops
+type Conn struct {
+	proxy string
+	auth  *Auth
+
+	mu sync.Mutex
+	// control connection, udp association lives as long as it
+	ctrl  *net.TCPConn
+	udp   *net.UDPConn
+	relay *net.UDPAddr
+	// deadlines are kept for the udp connections of reconnects
+	readDeadline  time.Time
+	writeDeadline time.Time
+	closed        bool
+	done          chan struct{}
+
+	// read buffer, room for the header of an IPv6 address
+	rmu  sync.Mutex
+	rbuf []byte
+}
+
+// ListenPacket connects to proxy and returns Conn, auth is nil if
+// proxy requires no authentication
+func ListenPacket(proxy string, auth *Auth) (*Conn, error) {
+	c := &Conn{proxy: proxy, auth: auth, done: make(chan struct{})}
+	ctrl, udp, relay, err := c.associate()
+	if err != nil {
+		return nil, err
+	}
+	c.ctrl, c.udp, c.relay = ctrl, udp, relay
+	go c.watch(ctrl)
+	return c, nil
+}
+
+// associate connects to proxy and sets up an udp association
+func (c *Conn) associate() (ctrl *net.TCPConn, udp *net.UDPConn, relay *net.UDPAddr, err error) {
+	conn, err := net.DialTimeout("tcp", c.proxy, DialTimeout)
+	if err != nil {
+		return
+	}
+	ctrl = conn.(*net.TCPConn)
+	ctrl.SetKeepAlive(true)
+	ctrl.SetKeepAlivePeriod(keepAlivePeriod)
+	defer func() {
+		if err != nil {
+			ctrl.Close()
+		}
+	}()
+	ctrl.SetDeadline(time.Now().Add(DialTimeout))
+	if err = c.handshake(ctrl); err != nil {
+		return
+	}
+	// the client address is not known before sending, so it is zero
+	if _, err = ctrl.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+	buf := make([]byte, 3)
+	if _, err = io.ReadFull(ctrl, buf); err != nil {
+		return
+	}
+	if buf[0] != 5 {
+		err = errors.New("socks5: invalid reply")
+		return
+	}
+	if buf[1] != 0 {
+		err = errors.New("socks5: udp associate failed, " + replyError(buf[1]))
+		return
+	}
+	if relay, err = readAddr(ctrl); err != nil {
+		return
+	}
+	if relay.IP.IsUnspecified() {
+		// the relay is at the address of proxy
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	if udp, err = net.DialUDP("udp", nil, relay); err != nil {
+		return
+	}
+	ctrl.SetDeadline(time.Time{})
+	return
+}
+
+// handshake negotiate the authentication method with proxy
+func (c *Conn) handshake(ctrl net.Conn) error {
+	methods := []byte{5, 1, 0}
+	if c.auth != nil {
+		methods = []byte{5, 2, 0, 2}
+	}
+	if _, err := ctrl.Write(methods); err != nil {
+		return err
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, buf); err != nil {
+		return err
+	}
+	if buf[0] != 5 {
+		return errors.New("socks5: invalid version")
+	}
+	switch {
+	case buf[1] == 0:
+		return nil
+	case buf[1] == 2 && c.auth != nil:
+	default:
+		return errors.New("socks5: no acceptable authentication method")
+	}
+	if len(c.auth.User) > 255 || len(c.auth.Password) > 255 {
+		return errors.New("socks5: username or password too long")
+	}
+	req := []byte{1, byte(len(c.auth.User))}
+	req = append(req, c.auth.User...)
+	req = append(req, byte(len(c.auth.Password)))
+	req = append(req, c.auth.Password...)
+	if _, err := ctrl.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(ctrl, buf); err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		return errors.New("socks5: authentication failed")
+	}
+	return nil
+}
+
+func replyError(code byte) string {
+	switch code {
+	case 1:
+		return "general failure"
+	case 2:
+		return "not allowed by ruleset"
+	case 7:
+		return "command not supported"
+	case 8:
+		return "address type not supported"
+	}
+	return "error " + strconv.Itoa(int(code))
+}
+
+// readAddr reads ATYP, ADDR and PORT of a reply
+func readAddr(r io.Reader) (*net.UDPAddr, error) {
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	var host string
+	switch buf[0] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if buf[0] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		name := make([]byte, buf[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		return nil, errors.New("socks5: invalid address type")
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+	return net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+}
+
+// watch reconnects to proxy after ctrl drops
+func (c *Conn) watch(ctrl *net.TCPConn) {
+	delay := ReconnectDelay
+	for {
+		// proxy sends nothing on the control connection
+		io.Copy(ioutil.Discard, ctrl)
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(delay):
+			}
+			nctrl, udp, relay, err := c.associate()
+			if err != nil {
+				if delay *= 2; delay > MaxReconnectDelay {
+					delay = MaxReconnectDelay
+				}
+				continue
+			}
+			c.mu.Lock()
+			if c.closed {
+				c.mu.Unlock()
+				nctrl.Close()
+				udp.Close()
+				return
+			}
+			udp.SetReadDeadline(c.readDeadline)
+			udp.SetWriteDeadline(c.writeDeadline)
+			c.ctrl.Close()
+			// the reader blocked on old one retries with new one
+			c.udp.Close()
+			c.ctrl, c.udp, c.relay = nctrl, udp, relay
+			c.mu.Unlock()
+			ctrl, delay = nctrl, ReconnectDelay
+			break
+		}
+	}
+}
+
+func (c *Conn) current() (*net.UDPConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, errClosed
+	}
+	return c.udp, nil
+}
+
+// ReadFrom reads a packet relayed by proxy
+func (c *Conn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.rbuf) < 22+len(b) {
+		c.rbuf = make([]byte, 22+len(b))
+	}
+	buf := c.rbuf[:22+len(b)]
+	for {
+		udp, err := c.current()
+		if err != nil {
+			return 0, nil, err
+		}
+		n, err := udp.Read(buf)
+		if err != nil {
+			if cur, cerr := c.current(); cerr == nil && cur != udp {
+				// reconnected
+				continue
+			}
+			return 0, nil, err
+		}
+		addr, data, err := unwrap(buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, data), addr, nil
+	}
+}
+
+// WriteTo sends a packet to addr through proxy
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("socks5: invalid address")
+	}
+	udp, err := c.current()
+	if err != nil {
+		return 0, err
+	}
+	if _, err = udp.Write(wrap(ua, b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// wrap adds the udp request header of addr to data
+func wrap(addr *net.UDPAddr, data []byte) []byte {
+	b := make([]byte, 0, 22+len(data))
+	b = append(b, 0, 0, 0)
+	if ip := addr.IP.To4(); ip != nil {
+		b = append(b, 1)
+		b = append(b, ip...)
+	} else {
+		b = append(b, 4)
+		b = append(b, addr.IP.To16()...)
+	}
+	b = append(b, byte(addr.Port>>8), byte(addr.Port))
+	return append(b, data...)
+}
+
+// unwrap parses the udp request header, the fragments are not supported
+func unwrap(b []byte) (*net.UDPAddr, []byte, error) {
+	if len(b) < 4 || b[2] != 0 {
+		return nil, nil, errors.New("socks5: invalid packet")
+	}
+	var n int
+	switch b[3] {
+	case 1:
+		n = 4
+	case 4:
+		n = 16
+	default:
+		return nil, nil, errors.New("socks5: invalid address type")
+	}
+	if len(b) < 4+n+2 {
+		return nil, nil, errors.New("socks5: invalid packet")
+	}
+	ip := make(net.IP, n)
+	copy(ip, b[4:])
+	port := int(binary.BigEndian.Uint16(b[4+n:]))
+	return &net.UDPAddr{IP: ip, Port: port}, b[4+n+2:], nil
+}
+
+// Close closes the connections to proxy
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	c.closed = true
+	close(c.done)
+	c.ctrl.Close()
+	return c.udp.Close()
+}
+
+// LocalAddr returns the address of relay as *Addr, DHT.Addr is nil
+// with Conn since the port can't be mapped or bound locally
+func (c *Conn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &Addr{*c.relay}
+}
+
+// SetDeadline set the read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline set the read deadline
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return c.udp.SetReadDeadline(t)
+}
+
+// SetWriteDeadline set the write deadline
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return c.udp.SetWriteDeadline(t)
+}
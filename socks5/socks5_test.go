@@ -0,0 +1,204 @@
+package socks5
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testServer is a SOCKS5 server which supports only UDP ASSOCIATE
+type testServer struct {
+	ln    *net.TCPListener
+	auth  *Auth
+	mu    sync.Mutex
+	ctrls []net.Conn
+}
+
+func newTestServer(t *testing.T, auth *Auth) *testServer {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{ln: ln, auth: auth}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+// drop closes all control connections
+func (s *testServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.ctrls {
+		c.Close()
+	}
+	s.ctrls = nil
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 512)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return
+	}
+	if s.auth == nil {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return
+		}
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != s.auth.User || string(pass) != s.auth.Password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+	if _, err := io.ReadFull(conn, buf[:10]); err != nil || buf[1] != 3 {
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	relay, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	port := relay.LocalAddr().(*net.UDPAddr).Port
+	// BND.ADDR is zero, client uses the address of server
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, byte(port >> 8), byte(port)})
+	s.mu.Lock()
+	s.ctrls = append(s.ctrls, conn)
+	s.mu.Unlock()
+
+	go func() {
+		var client *net.UDPAddr
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			if client == nil || addr.String() == client.String() {
+				client = addr
+				to, data, err := unwrap(buf[:n])
+				if err == nil {
+					relay.WriteToUDP(data, to)
+				}
+			} else if client != nil {
+				relay.WriteToUDP(wrap(addr, buf[:n]), client)
+			}
+		}
+	}()
+	io.Copy(ioutil.Discard, conn)
+}
+
+func newEchoServer(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return conn
+}
+
+func testEcho(c *Conn, echo net.Addr) error {
+	c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := c.WriteTo([]byte("hello"), echo); err != nil {
+		return err
+	}
+	buf := make([]byte, 64)
+	n, addr, err := c.ReadFrom(buf)
+	if err != nil {
+		return err
+	}
+	if string(buf[:n]) != "hello" || addr.String() != echo.String() {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func Test_Conn(t *testing.T) {
+	ReconnectDelay = 10 * time.Millisecond
+	auth := &Auth{"user", "pass"}
+	s := newTestServer(t, auth)
+	defer s.ln.Close()
+	echo := newEchoServer(t)
+	defer echo.Close()
+
+	if _, err := ListenPacket(s.ln.Addr().String(), &Auth{"user", "bad"}); err == nil {
+		t.Fatal("auth")
+	}
+	c, err := ListenPacket(s.ln.Addr().String(), auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = testEcho(c, echo.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	relay := c.LocalAddr().String()
+
+	s.drop()
+	for i := 0; c.LocalAddr().String() == relay; i++ {
+		if i > 100 {
+			t.Fatal("reconnect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err = testEcho(c, echo.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Close()
+	if _, err = c.WriteTo([]byte("hello"), echo.LocalAddr()); err != errClosed {
+		t.Fatal(err)
+	}
+}
+
+func Test_wrap(t *testing.T) {
+	for _, s := range []string{"1.2.3.4:6881", "[2001:db8::1]:6881"} {
+		addr, _ := net.ResolveUDPAddr("udp", s)
+		a, data, err := unwrap(wrap(addr, []byte("data")))
+		if err != nil || a.String() != s || string(data) != "data" {
+			t.Fatal(a, data, err)
+		}
+	}
+	if _, _, err := unwrap([]byte{0, 0, 1, 1, 1, 2, 3, 4, 0, 1}); err == nil {
+		t.Fatal("fragment")
+	}
+}
+
+func Test_Addr(t *testing.T) {
+	var c Conn
+	c.relay = &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+	addr := c.LocalAddr()
+	if _, ok := addr.(*net.UDPAddr); ok || addr.Network() != "socks5" || addr.String() != "1.2.3.4:6881" {
+		t.Fatal(addr)
+	}
+}
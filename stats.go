@@ -0,0 +1,336 @@
+package dht
+
+import (
+	"container/list"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TorrentStats is the statistics of an infohash over the last hour and day
+type TorrentStats struct {
+	ID            *ID
+	HourQueries   int
+	DayQueries    int
+	HourAnnounces int
+	DayAnnounces  int
+	// estimated count of unique ips which queried or announced
+	HourIPs   int
+	DayIPs    int
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// StatsOrder is the order of Stats.Top
+type StatsOrder int
+
+const (
+	// ByHourQueries orders by get_peers queries of last hour
+	ByHourQueries StatsOrder = iota
+	// ByDayQueries orders by get_peers queries of last day
+	ByDayQueries
+	// ByHourAnnounces orders by announces of last hour
+	ByHourAnnounces
+	// ByDayAnnounces orders by announces of last day
+	ByDayAnnounces
+	// ByHourIPs orders by unique ips of last hour
+	ByHourIPs
+	// ByDayIPs orders by unique ips of last day
+	ByDayIPs
+)
+
+func (o StatsOrder) key(s *TorrentStats) int {
+	switch o {
+	case ByHourQueries:
+		return s.HourQueries
+	case ByDayQueries:
+		return s.DayQueries
+	case ByHourAnnounces:
+		return s.HourAnnounces
+	case ByDayAnnounces:
+		return s.DayAnnounces
+	case ByHourIPs:
+		return s.HourIPs
+	}
+	return s.DayIPs
+}
+
+// slidingCount counts events of the last len(slots) slots
+type slidingCount struct {
+	slot  time.Duration
+	slots []uint32
+	// index of current slot since unix epoch
+	head int64
+}
+
+func newSlidingCount(slot time.Duration, n int) slidingCount {
+	return slidingCount{slot: slot, slots: make([]uint32, n)}
+}
+
+func (c *slidingCount) advance(t time.Time) {
+	i := t.UnixNano() / int64(c.slot)
+	n := int64(len(c.slots))
+	if i-c.head >= n {
+		for j := range c.slots {
+			c.slots[j] = 0
+		}
+	} else {
+		for j := c.head + 1; j <= i; j++ {
+			c.slots[j%n] = 0
+		}
+	}
+	if i > c.head {
+		c.head = i
+	}
+}
+
+func (c *slidingCount) Add(t time.Time) {
+	c.advance(t)
+	c.slots[c.head%int64(len(c.slots))]++
+}
+
+func (c *slidingCount) Sum(t time.Time) (n int) {
+	c.advance(t)
+	for _, v := range c.slots {
+		n += int(v)
+	}
+	return
+}
+
+// sketchBits is the count of hash bits indexing the registers of
+// ipSketch, the standard error of estimates is about 1.04/sqrt(256)
+const sketchBits = 8
+
+type sketchEntry struct {
+	reg  uint8
+	rank uint8
+	time int64
+}
+
+// ipSketch is a sliding HyperLogLog which estimates unique ips seen
+// in a recent window. A register keeps the ranks which are not
+// outranked by a later one, so that its max rank of any window is known.
+type ipSketch struct {
+	entries []sketchEntry
+}
+
+func hashIP(ip net.IP) uint64 {
+	h := fnv.New64a()
+	h.Write(ip.To16())
+	x := h.Sum64()
+	// finalizer of splitmix64 spreads the similar addresses
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Add an ip seen at t, the entries older than age are removed
+func (s *ipSketch) Add(ip net.IP, t time.Time, age time.Duration) {
+	x := hashIP(ip)
+	reg := uint8(x >> (64 - sketchBits))
+	rank := uint8(bits.LeadingZeros64(x<<sketchBits|1<<(sketchBits-1)) + 1)
+	now, old := t.UnixNano(), t.Add(-age).UnixNano()
+	entries := s.entries[:0]
+	for _, e := range s.entries {
+		if e.time < old || e.reg == reg && e.rank <= rank {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	s.entries = append(entries, sketchEntry{reg, rank, now})
+}
+
+// Count returns estimated unique ips seen since t
+func (s *ipSketch) Count(t time.Time) int {
+	var ranks [1 << sketchBits]uint8
+	since := t.UnixNano()
+	for _, e := range s.entries {
+		if e.time >= since && e.rank > ranks[e.reg] {
+			ranks[e.reg] = e.rank
+		}
+	}
+	m := float64(len(ranks))
+	sum, zeros := 0.0, 0
+	for _, r := range ranks {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int(e + 0.5)
+}
+
+type torrentStats struct {
+	id        *ID
+	hourQ     slidingCount
+	dayQ      slidingCount
+	hourA     slidingCount
+	dayA      slidingCount
+	ips       ipSketch
+	firstSeen time.Time
+	lastSeen  time.Time
+	elem      *list.Element
+}
+
+func newTorrentStats(id *ID, t time.Time) *torrentStats {
+	return &torrentStats{
+		id:        id,
+		hourQ:     newSlidingCount(5*time.Minute, 12),
+		dayQ:      newSlidingCount(time.Hour, 24),
+		hourA:     newSlidingCount(5*time.Minute, 12),
+		dayA:      newSlidingCount(time.Hour, 24),
+		firstSeen: t,
+	}
+}
+
+func (s *torrentStats) Stats(t time.Time) TorrentStats {
+	return TorrentStats{
+		ID:            s.id,
+		HourQueries:   s.hourQ.Sum(t),
+		DayQueries:    s.dayQ.Sum(t),
+		HourAnnounces: s.hourA.Sum(t),
+		DayAnnounces:  s.dayA.Sum(t),
+		HourIPs:       s.ips.Count(t.Add(-time.Hour)),
+		DayIPs:        s.ips.Count(t.Add(-24 * time.Hour)),
+		FirstSeen:     s.firstSeen,
+		LastSeen:      s.lastSeen,
+	}
+}
+
+// Stats counts the get_peers queries and announces of every
+// infohash, it is safe for concurrent use
+type Stats struct {
+	mu  sync.Mutex
+	cap int
+	ts  map[ID]*torrentStats
+	// least recently seen first
+	lru *list.List
+}
+
+// NewStats returns Stats which tracks at most cap infohashes,
+// the least recently seen one is dropped if it is full
+func NewStats(cap int) *Stats {
+	return &Stats{
+		cap: cap,
+		ts:  make(map[ID]*torrentStats),
+		lru: list.New(),
+	}
+}
+
+// Count returns count of the tracked infohashes
+func (s *Stats) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.ts)
+}
+
+func (s *Stats) get(tor *ID, ip net.IP, t time.Time) *torrentStats {
+	ts, ok := s.ts[*tor]
+	if !ok {
+		if s.lru.Len() >= s.cap {
+			if e := s.lru.Front(); e != nil {
+				s.remove(e.Value.(*torrentStats))
+			}
+		}
+		ts = newTorrentStats(tor, t)
+		ts.elem = s.lru.PushBack(ts)
+		s.ts[*tor] = ts
+	}
+	ts.lastSeen = t
+	s.lru.MoveToBack(ts.elem)
+	if ip != nil {
+		ts.ips.Add(ip, t, 24*time.Hour)
+	}
+	return ts
+}
+
+func (s *Stats) remove(ts *torrentStats) {
+	s.lru.Remove(ts.elem)
+	delete(s.ts, *ts.id)
+}
+
+// Query count a get_peers query of ip
+func (s *Stats) Query(tor *ID, ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := time.Now()
+	ts := s.get(tor, ip, t)
+	ts.hourQ.Add(t)
+	ts.dayQ.Add(t)
+}
+
+// Announce count an announce of ip
+func (s *Stats) Announce(tor *ID, ip net.IP) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := time.Now()
+	ts := s.get(tor, ip, t)
+	ts.hourA.Add(t)
+	ts.dayA.Add(t)
+}
+
+// Find returns the statistics of an infohash
+func (s *Stats) Find(tor *ID) (TorrentStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ts, ok := s.ts[*tor]; ok {
+		return ts.Stats(time.Now()), true
+	}
+	return TorrentStats{}, false
+}
+
+// Top returns the first n infohashes in order, the most first
+func (s *Stats) Top(n int, order StatsOrder) []TorrentStats {
+	all := s.all()
+	sort.SliceStable(all, func(i, j int) bool {
+		return order.key(&all[i]) > order.key(&all[j])
+	})
+	if n >= 0 && len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// Expire remove the infohashes not seen in the last day
+func (s *Stats) Expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for e := s.lru.Front(); e != nil; e = s.lru.Front() {
+		ts := e.Value.(*torrentStats)
+		if time.Since(ts.lastSeen) <= 24*time.Hour {
+			return
+		}
+		s.remove(ts)
+	}
+}
+
+// Map all infohashes, the least recently seen first
+func (s *Stats) Map(f func(ts TorrentStats) bool) {
+	for _, ts := range s.all() {
+		if f(ts) == false {
+			return
+		}
+	}
+}
+
+func (s *Stats) all() []TorrentStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := time.Now()
+	all := make([]TorrentStats, 0, len(s.ts))
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		all = append(all, e.Value.(*torrentStats).Stats(t))
+	}
+	return all
+}
@@ -0,0 +1,54 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_slidingCount(t *testing.T) {
+	c := newSlidingCount(time.Minute, 5)
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		c.Add(now.Add(time.Duration(i) * time.Minute))
+	}
+	if n := c.Sum(now.Add(9 * time.Minute)); n != 5 {
+		t.Fatal(n)
+	}
+	if n := c.Sum(now.Add(time.Hour)); n != 0 {
+		t.Fatal(n)
+	}
+}
+
+func Test_ipSketch(t *testing.T) {
+	var s ipSketch
+	now := time.Now()
+	for i := 999; i >= 0; i-- {
+		ip := net.IPv4(10, 0, byte(i>>8), byte(i))
+		s.Add(ip, now.Add(-time.Duration(i)*time.Second), time.Hour)
+		s.Add(ip, now.Add(-time.Duration(i)*time.Second), time.Hour)
+	}
+	if n := s.Count(now.Add(-time.Hour)); n < 700 || n > 1300 {
+		t.Fatal(n)
+	}
+	if n := s.Count(now.Add(-100 * time.Second)); n < 70 || n > 130 {
+		t.Fatal(n)
+	}
+}
+
+func Test_Stats(t *testing.T) {
+	s := NewStats(2)
+	id1, id2, id3 := newRandomID(), newRandomID(), newRandomID()
+	s.Query(id1, net.ParseIP("1.2.3.4"))
+	s.Query(id2, net.ParseIP("1.2.3.4"))
+	s.Query(id2, net.ParseIP("1.2.3.5"))
+	s.Announce(id2, net.ParseIP("1.2.3.5"))
+	top := s.Top(1, ByDayQueries)
+	if len(top) != 1 || top[0].ID != id2 || top[0].DayQueries != 2 || top[0].HourAnnounces != 1 || top[0].DayIPs != 2 {
+		t.Fatal(top)
+	}
+	s.Query(id3, nil)
+	if _, ok := s.Find(id1); ok || s.Count() != 2 {
+		t.Fatal(s.Count())
+	}
+}
@@ -1,18 +1,79 @@
 package dht
 
 import (
+	"container/list"
+	"errors"
 	"time"
 )
 
+// PeerStore stores the peers announced to DHT
+type PeerStore interface {
+	// Insert an announced peer of infohash
+	Insert(tor *ID, peer []byte) error
+	// Lookup returns at most max peers of infohash, the most recently
+	// announced first, max <= 0 is unlimited
+	Lookup(tor *ID, max int) [][]byte
+	// Expire remove the peers announced before tm ago
+	Expire(tm time.Duration)
+	// Count returns count of infohashes
+	Count() int
+	// NumPeers returns count of peers of infohash
+	NumPeers(tor *ID) int
+	// Map all peers
+	Map(f func(tor *ID, peer []byte, t time.Time) bool)
+}
+
+// estimated memory of a stored peer and infohash besides peer bytes
+const (
+	peerOverhead    = 64
+	torrentOverhead = 128
+)
+
+// StoreLimits configure the peer store, 0 is unlimited
+type StoreLimits struct {
+	// MaxTorrents is the max count of infohashes
+	MaxTorrents int
+	// MaxPeers is the max count of peers of an infohash
+	MaxPeers int
+	// MaxBytes is the estimated memory budget
+	MaxBytes int
+}
+
+// StoreStats counts the peer store
+type StoreStats struct {
+	Torrents int
+	Peers    int
+	Bytes    int
+	// evicted least recently announced peers
+	PeerEvictions int
+	// evicted least recently queried infohashes
+	TorrentEvictions int
+	// rejected announces
+	Rejects int
+	// ips penalized by AnnounceLimit
+	Penalties int
+}
+
+type storagePeer struct {
+	peer string
+	time time.Time
+	st   *storage
+	// element of all peers ordered by announce time
+	all *list.Element
+}
+
 type storage struct {
-	id *ID
-	ps map[string]time.Time
+	id    *ID
+	ps    *list.List
+	index map[string]*list.Element
+	elem  *list.Element
 }
 
 func newStorage(id *ID) *storage {
 	return &storage{
-		id: id,
-		ps: make(map[string]time.Time),
+		id:    id,
+		ps:    list.New(),
+		index: make(map[string]*list.Element),
 	}
 }
 
@@ -21,61 +82,266 @@ func (s *storage) ID() *ID {
 }
 
 func (s *storage) Count() int {
-	return len(s.ps)
+	return s.ps.Len()
+}
+
+// Insert a peer, returns true if it is new
+func (s *storage) Insert(peer []byte, t time.Time) (p *storagePeer, ok bool) {
+	if e, ok := s.index[string(peer)]; ok {
+		p = e.Value.(*storagePeer)
+		p.time = t
+		s.ps.MoveToBack(e)
+		return p, false
+	}
+	p = &storagePeer{peer: string(peer), time: t, st: s}
+	s.index[p.peer] = s.ps.PushBack(p)
+	return p, true
 }
 
-func (s *storage) Insert(peer []byte) {
-	s.ps[string(peer)] = time.Now()
+func (s *storage) Remove(peer []byte) *storagePeer {
+	if e, ok := s.index[string(peer)]; ok {
+		delete(s.index, string(peer))
+		s.ps.Remove(e)
+		return e.Value.(*storagePeer)
+	}
+	return nil
 }
 
-func (s *storage) Remove(peer []byte) {
-	delete(s.ps, string(peer))
+// Oldest returns the least recently announced peer
+func (s *storage) Oldest() (peer []byte, t time.Time) {
+	if e := s.ps.Front(); e != nil {
+		p := e.Value.(*storagePeer)
+		return []byte(p.peer), p.time
+	}
+	return
 }
 
+// Map all peers, the most recently announced first
 func (s *storage) Map(f func(p []byte, t time.Time) bool) {
-	for peer, time := range s.ps {
-		if f([]byte(peer), time) == false {
+	for e := s.ps.Back(); e != nil; e = e.Prev() {
+		p := e.Value.(*storagePeer)
+		if f([]byte(p.peer), p.time) == false {
 			return
 		}
 	}
 }
 
-type storages struct {
-	ss map[ID]*storage
+// MemoryStore is the default PeerStore, it keeps peers in memory
+// and evicts them by StoreLimits
+type MemoryStore struct {
+	limits StoreLimits
+	stats  StoreStats
+	ss     map[ID]*storage
+	// least recently queried first
+	lru *list.List
+	// least recently announced first
+	peers *list.List
 }
 
-func newStorages() *storages {
-	return &storages{
-		ss: make(map[ID]*storage),
+// NewMemoryStore returns MemoryStore with the default limits
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		limits: StoreLimits{
+			MaxTorrents: 102400,
+			MaxPeers:    1024,
+		},
+		ss:    make(map[ID]*storage),
+		lru:   list.New(),
+		peers: list.New(),
 	}
 }
 
-func (s *storages) Count() int {
+// Count returns count of infohashes
+func (s *MemoryStore) Count() int {
 	return len(s.ss)
 }
 
-func (s *storages) Find(id *ID) *storage {
+// NumPeers returns count of peers of infohash
+func (s *MemoryStore) NumPeers(tor *ID) int {
+	if st := s.find(tor); st != nil {
+		return st.Count()
+	}
+	return 0
+}
+
+func (s *MemoryStore) find(id *ID) *storage {
 	if st, ok := s.ss[*id]; ok {
 		return st
 	}
 	return nil
 }
 
-func (s *storages) Get(id *ID) (st *storage) {
-	if st = s.Find(id); st == nil {
+func (s *MemoryStore) get(id *ID) (st *storage) {
+	if st = s.find(id); st == nil {
+		if n := s.limits.MaxTorrents; n > 0 && len(s.ss) >= n {
+			s.evictTorrent()
+		}
 		st = newStorage(id)
+		st.elem = s.lru.PushBack(st)
 		s.ss[*id] = st
+		s.stats.Bytes += torrentOverhead
+	}
+	return
+}
+
+// Insert a peer, the least recently announced peer of the infohash is
+// evicted if it is full, and the least recently queried infohashes are
+// evicted if memory budget is exceeded
+func (s *MemoryStore) Insert(tor *ID, peer []byte) error {
+	return s.insert(tor, peer, time.Now())
+}
+
+func (s *MemoryStore) insert(tor *ID, peer []byte, t time.Time) error {
+	if n := len(peer); n != 6 && n != 18 {
+		s.stats.Rejects++
+		return errors.New("invalid peer")
+	}
+	st := s.get(tor)
+	if _, ok := st.index[string(peer)]; !ok {
+		if n := s.limits.MaxPeers; n > 0 && st.Count() >= n {
+			s.evictPeer(st)
+		}
+	}
+	if p, ok := st.Insert(peer, t); ok {
+		p.all = s.peers.PushBack(p)
+		s.stats.Peers++
+		s.stats.Bytes += len(peer) + peerOverhead
+	} else {
+		s.peers.MoveToBack(p.all)
+	}
+	s.trim(st)
+	return nil
+}
+
+// Lookup returns the most recently announced peers and marks the
+// infohash as recently queried
+func (s *MemoryStore) Lookup(tor *ID, max int) (ps [][]byte) {
+	if st := s.find(tor); st != nil {
+		s.lru.MoveToBack(st.elem)
+		st.Map(func(peer []byte, t time.Time) bool {
+			ps = append(ps, peer)
+			return max <= 0 || len(ps) < max
+		})
 	}
 	return
 }
 
-func (s *storages) Remove(id *ID) {
-	delete(s.ss, *id)
+// SetLimits set the limits and evict over limit peers and infohashes
+func (s *MemoryStore) SetLimits(l StoreLimits) {
+	s.limits = l
+	for n := l.MaxTorrents; n > 0 && len(s.ss) > n; {
+		s.evictTorrent()
+	}
+	if n := l.MaxPeers; n > 0 {
+		for _, st := range s.ss {
+			for st.Count() > n {
+				s.evictPeer(st)
+			}
+		}
+	}
+	s.trim(nil)
+}
+
+// trim evict peers of the least recently queried infohashes until
+// memory budget is met, the peers of keep are evicted at last
+func (s *MemoryStore) trim(keep *storage) {
+	for s.limits.MaxBytes > 0 && s.stats.Bytes > s.limits.MaxBytes {
+		e := s.lru.Front()
+		if e == nil {
+			return
+		}
+		if st := e.Value.(*storage); st == keep {
+			if e.Next() == nil {
+				if st.Count() <= 1 {
+					return
+				}
+				s.evictPeer(st)
+				continue
+			}
+			e = e.Next()
+		}
+		s.evictPeer(e.Value.(*storage))
+	}
+}
+
+func (s *MemoryStore) evictPeer(st *storage) {
+	if peer, _ := st.Oldest(); peer != nil {
+		s.removePeer(st, peer)
+		s.stats.PeerEvictions++
+	}
+}
+
+func (s *MemoryStore) evictTorrent() {
+	if e := s.lru.Front(); e != nil {
+		s.Remove(e.Value.(*storage).id)
+		s.stats.TorrentEvictions++
+	}
+}
+
+func (s *MemoryStore) removePeer(st *storage, peer []byte) {
+	if p := st.Remove(peer); p != nil {
+		s.peers.Remove(p.all)
+		s.stats.Peers--
+		s.stats.Bytes -= len(peer) + peerOverhead
+	}
+	if st.Count() == 0 {
+		s.Remove(st.id)
+	}
+}
+
+// Remove an infohash and its peers
+func (s *MemoryStore) Remove(tor *ID) {
+	if st := s.find(tor); st != nil {
+		s.stats.Peers -= st.Count()
+		s.stats.Bytes -= torrentOverhead
+		for e := st.ps.Front(); e != nil; e = e.Next() {
+			p := e.Value.(*storagePeer)
+			s.peers.Remove(p.all)
+			s.stats.Bytes -= len(p.peer) + peerOverhead
+		}
+		s.lru.Remove(st.elem)
+		delete(s.ss, *tor)
+	}
+}
+
+// Expire remove the peers announced before tm ago, only the expired
+// peers are visited
+func (s *MemoryStore) Expire(tm time.Duration) {
+	for e := s.peers.Front(); e != nil; e = s.peers.Front() {
+		p := e.Value.(*storagePeer)
+		if time.Since(p.time) <= tm {
+			return
+		}
+		s.removePeer(p.st, []byte(p.peer))
+	}
+}
+
+// Stats returns size and eviction counts
+func (s *MemoryStore) Stats() StoreStats {
+	stats := s.stats
+	stats.Torrents = len(s.ss)
+	return stats
+}
+
+// Map all peers, the infohashes least recently queried first and
+// their peers least recently announced first
+func (s *MemoryStore) Map(f func(tor *ID, peer []byte, t time.Time) bool) {
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		st := e.Value.(*storage)
+		for pe := st.ps.Front(); pe != nil; pe = pe.Next() {
+			p := pe.Value.(*storagePeer)
+			if f(st.id, []byte(p.peer), p.time) == false {
+				return
+			}
+		}
+	}
 }
 
-func (s *storages) Map(f func(st *storage) bool) {
-	for _, st := range s.ss {
-		if f(st) == false {
+// mapAnnounced maps all peers, the least recently announced first
+func (s *MemoryStore) mapAnnounced(f func(tor *ID, peer []byte, t time.Time) bool) {
+	for e := s.peers.Front(); e != nil; e = e.Next() {
+		p := e.Value.(*storagePeer)
+		if f(p.st.id, []byte(p.peer), p.time) == false {
 			return
 		}
 	}
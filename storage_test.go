@@ -1 +1,55 @@
 package dht
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func peer(n int) []byte {
+	return createPeer(net.IPv4(1, 2, 3, byte(n)), 6881)
+}
+
+func Test_MemoryStore_Limits(t *testing.T) {
+	s := NewMemoryStore()
+	s.SetLimits(StoreLimits{MaxTorrents: 2, MaxPeers: 2})
+
+	id1, id2, id3 := newRandomID(), newRandomID(), newRandomID()
+	s.Insert(id1, peer(1))
+	s.Insert(id1, peer(2))
+	s.Insert(id1, peer(3))
+	if st := s.find(id1); st.Count() != 2 {
+		t.Fatal(st.Count())
+	} else if p, _ := st.Oldest(); !bytes.Equal(p, peer(2)) {
+		t.Fatal(p)
+	}
+
+	s.Insert(id2, peer(1))
+	// id1 is queried, id2 is least recently queried
+	if ps := s.Lookup(id1, 1); len(ps) != 1 || !bytes.Equal(ps[0], peer(3)) {
+		t.Fatal(ps)
+	}
+	s.Insert(id3, peer(1))
+	if s.find(id2) != nil || s.find(id1) == nil || s.find(id3) == nil {
+		t.Fatal("evict")
+	}
+
+	stats := s.Stats()
+	if stats.Torrents != 2 || stats.Peers != 3 || stats.PeerEvictions != 1 || stats.TorrentEvictions != 1 {
+		t.Fatal(stats)
+	}
+	if stats.Bytes != 2*torrentOverhead+3*(6+peerOverhead) {
+		t.Fatal(stats.Bytes)
+	}
+
+	s.SetLimits(StoreLimits{MaxBytes: torrentOverhead + 6 + peerOverhead})
+	if s.Count() != 1 || s.find(id3) == nil {
+		t.Fatal(s.Count())
+	}
+
+	s.Expire(-time.Second)
+	if stats = s.Stats(); s.Count() != 0 || stats.Peers != 0 || stats.Bytes != 0 {
+		t.Fatal(stats)
+	}
+}
@@ -1,37 +1,106 @@
 package dht
 
 import (
-	"container/list"
+	"container/heap"
 	"errors"
 	"fmt"
 	"net"
 	"sort"
+	"time"
 )
 
+// errBucketFull is returned by Insert if the node is cached as a
+// replacement of a full bucket
+var errBucketFull = errors.New("drop this node")
+
 // Table store all nodes
 type Table struct {
-	id      *ID
-	ksize   int
-	buckets *list.List
+	id    *ID
+	ksize int
+	caps  []int
+	// max nodes of a /24 (IPv4) or /64 (IPv6) subnet in a bucket
+	// and in the table, 0 is unlimited
+	bucketSubnet int
+	tableSubnet  int
+	limits       *nodeLimits
+	// buckets[i] holds the nodes sharing i leading bits with id,
+	// the last bucket holds the rest and is the only one to split
+	buckets []*Bucket
 }
 
-// NewTable returns a table
-func NewTable(id *ID, ksize int) *Table {
+// NewTable returns a table, caps[i] is the capacity of the bucket at
+// depth i and the deeper buckets hold ksize nodes, e.g.
+// NewTable(id, 8, 128, 64, 32, 16)
+func NewTable(id *ID, ksize int, caps ...int) *Table {
 	t := &Table{
-		id:      id,
-		ksize:   ksize,
-		buckets: list.New(),
+		id:           id,
+		ksize:        ksize,
+		caps:         caps,
+		bucketSubnet: 2,
+		tableSubnet:  8,
 	}
-	b := NewBucket(ZeroID, ksize)
-	t.buckets.PushBack(b)
+	limits := defaultNodeLimits
+	t.limits = &limits
+	t.buckets = append(t.buckets, t.newBucket(ZeroID, t.Capacity(0)))
 	return t
 }
 
+func (t *Table) newBucket(first *ID, cap int) *Bucket {
+	b := NewBucket(first, cap)
+	b.accept = func(n *Node) bool {
+		return t.accept(b, n.addr)
+	}
+	b.limits = t.limits
+	return b
+}
+
+// SetNodeLimits set how long a node stays good without activity and
+// how many queries in a row it may fail before it goes bad
+func (t *Table) SetNodeLimits(good time.Duration, fails int) {
+	t.limits.goodTimeout = good
+	t.limits.maxFails = fails
+}
+
+// SetSubnetLimits set the max nodes of a /24 (IPv4) or /64 (IPv6)
+// subnet in a bucket and in the table, 0 is unlimited
+func (t *Table) SetSubnetLimits(bucket, table int) {
+	t.bucketSubnet = bucket
+	t.tableSubnet = table
+}
+
+// NumSubnet returns count of nodes in the subnet of ip
+func (t *Table) NumSubnet(ip net.IP) (n int) {
+	t.Map(func(b *Bucket) bool {
+		n += b.NumSubnet(ip)
+		return true
+	})
+	return
+}
+
+// accept returns false if the subnet of addr reaches the limits
+func (t *Table) accept(b *Bucket, addr *net.UDPAddr) bool {
+	if addr == nil {
+		return true
+	}
+	if t.bucketSubnet > 0 && b.NumSubnet(addr.IP) >= t.bucketSubnet {
+		return false
+	}
+	return t.tableSubnet <= 0 || t.NumSubnet(addr.IP) < t.tableSubnet
+}
+
 // KSize returns bucket capaticy
 func (t *Table) KSize() int {
 	return t.ksize
 }
 
+// Capacity returns capacity of the bucket at depth
+func (t *Table) Capacity(depth int) int {
+	if depth < len(t.caps) && t.caps[depth] > 0 {
+		return t.caps[depth]
+	}
+	return t.ksize
+}
+
 // NumNodes returns all node count
 func (t *Table) NumNodes() (n int) {
 	t.Map(func(b *Bucket) bool {
@@ -50,160 +119,211 @@ func (t *Table) Insert(id *ID, addr *net.UDPAddr) (*Node, error) {
 }
 
 func (t *Table) insert(id *ID, addr *net.UDPAddr) (n *Node, err error) {
-	if e := t.find(id); e != nil {
-		if n = e.Value.(*Bucket).Insert(id, addr); n != nil {
-			return
-		}
-		if inBucket(t.id, e) && t.split(e) {
-			return t.insert(id, addr)
-		}
+	i := t.index(id)
+	b := t.buckets[i]
+	if n = b.Find(id); n == nil {
+		n = b.Cached(id)
 	}
-	err = errors.New("drop this node")
+	if n != nil && !sameIP(n.addr, addr) {
+		return nil, errors.New("id used by another address")
+	}
+	if b.Find(id) == nil && !t.accept(b, addr) {
+		return nil, errors.New("too many nodes of subnet")
+	}
+	if n = b.Insert(id, addr); n != nil {
+		return
+	}
+	if i == len(t.buckets)-1 && t.split() {
+		return t.insert(id, addr)
+	}
+	b.Cache(id, addr)
+	err = errBucketFull
 	return
 }
 
-func (t *Table) split(e *list.Element) bool {
-	bit := e.Value.(*Bucket).first.LowBit()
-	if next := e.Next(); next != nil {
-		bit2 := next.Value.(*Bucket).first.LowBit()
-		if bit < bit2 {
-			bit = bit2
-		}
-	}
-	if bit++; bit >= 160 {
+func (t *Table) split() bool {
+	depth := len(t.buckets) - 1
+	if depth+1 >= 8*IDLen {
 		return false
 	}
-
-	b := e.Value.(*Bucket)
-	first, _ := NewID(b.first.Bytes())
-	first.SetBit(bit, true)
-	b2 := NewBucket(first, b.cap)
-	t.buckets.InsertAfter(b2, e)
-
-	var eles []*list.Element
-	b.handle(func(be *list.Element) bool {
-		if inBucket(be.Value.(*Node).id, e) == false {
-			eles = append(eles, be)
-		}
-		return true
+	b := t.buckets[depth]
+	b.first = t.id.prefix(depth, true)
+	b2 := t.newBucket(t.id.prefix(depth+1, false), t.Capacity(depth+1))
+	b.split(b2, func(n *Node) bool {
+		return t.id.PrefixLen(n.id) > depth
 	})
-	for _, ele := range eles {
-		b2.nodes.PushBack(b.nodes.Remove(ele))
-	}
-
+	t.buckets = append(t.buckets, b2)
 	return true
 }
 
 // Find returns bucket
 func (t *Table) Find(id *ID) *Bucket {
-	if e := t.find(id); e != nil {
-		return e.Value.(*Bucket)
-	}
-	return nil
+	return t.buckets[t.index(id)]
 }
 
-func (t *Table) find(id *ID) (ele *list.Element) {
-	t.handle(func(e *list.Element) bool {
-		if inBucket(id, e) {
-			ele = e
-			return false
-		}
-		return true
-	})
-	return
+func (t *Table) index(id *ID) int {
+	if i := t.id.PrefixLen(id); i < len(t.buckets)-1 {
+		return i
+	}
+	return len(t.buckets) - 1
 }
 
-// Lookup returns the K(8) closest good nodes
+// Lookup returns the K(8) closest nodes, good nodes come first and
+// the nodes of distinct subnets are preferred
 func (t *Table) Lookup(id *ID) []*Node {
-	e := t.find(id)
-	if e == nil {
-		return nil
-	}
-
-	ln := newLookupNodes(id, t.ksize)
-	if ln.CopyFrom(e); ln.Len() < t.ksize {
-		prev, next := e.Prev(), e.Next()
-		for ln.Len() < t.ksize && (prev != nil || next != nil) {
-			if prev != nil {
-				ln.CopyFrom(prev)
-				prev = prev.Prev()
-			}
-			if next != nil {
-				ln.CopyFrom(next)
-				next = next.Next()
+	return t.lookup(id, t.ksize)
+}
+
+func (t *Table) lookup(id *ID, k int) []*Node {
+	// collect twice as many nodes to choose diverse subnets
+	good := newClosestNodes(id, 2*k)
+	other := newClosestNodes(id, 2*k)
+	collect := func(b *Bucket) {
+		b.Map(func(n *Node) bool {
+			switch n.State() {
+			case NodeGood:
+				good.Push(n)
+			case NodeQuestionable:
+				other.Push(n)
 			}
-		}
+			return true
+		})
 	}
-	sort.Sort(ln)
 
-	if ln.Len() > t.ksize {
-		return ln.nodes[:t.ksize]
+	// every node of a group is closer to id than any node of the next
+	// group: the bucket of id, the deeper buckets, then the shallower
+	// buckets from the deepest one
+	i, last := t.index(id), len(t.buckets)-1
+	collect(t.buckets[i])
+	if good.Len() < 2*k && i < last {
+		for j := i + 1; j <= last; j++ {
+			collect(t.buckets[j])
+		}
 	}
-	return ln.nodes
+	for j := i - 1; j >= 0 && good.Len() < 2*k; j-- {
+		collect(t.buckets[j])
+	}
+
+	return diverse(append(good.Sorted(), other.Sorted()...), k)
 }
 
-func inBucket(id *ID, e *list.Element) bool {
-	if b := e.Value.(*Bucket); b.first.Compare(id) > 0 {
-		return false
+// diverse returns k nodes in order, a node of a subnet already chosen
+// is taken only if there are not enough nodes
+func diverse(nodes []*Node, k int) []*Node {
+	if len(nodes) <= k {
+		if len(nodes) == 0 {
+			return nil
+		}
+		return nodes
 	}
-	if n := e.Next(); n != nil {
-		if b := n.Value.(*Bucket); b.first.Compare(id) <= 0 {
-			return false
+	chosen := make([]bool, len(nodes))
+	subnets := make(map[string]bool)
+	n := 0
+	for i, node := range nodes {
+		if n == k {
+			break
+		}
+		if node.addr == nil {
+			chosen[i] = true
+			n++
+			continue
+		}
+		if sn := subnet(node.addr.IP); !subnets[sn] {
+			subnets[sn] = true
+			chosen[i] = true
+			n++
 		}
 	}
-	return true
+	for i := range nodes {
+		if n == k {
+			break
+		}
+		if !chosen[i] {
+			chosen[i] = true
+			n++
+		}
+	}
+	ns := make([]*Node, 0, k)
+	for i, node := range nodes {
+		if chosen[i] {
+			ns = append(ns, node)
+		}
+	}
+	return ns
 }
 
-type lookupNodes struct {
+func sameIP(a, b *net.UDPAddr) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP)
+}
+
+// closestNodes keeps the k closest nodes to id in a max heap
+type closestNodes struct {
 	id    *ID
+	k     int
 	nodes []*Node
 }
 
-func newLookupNodes(id *ID, cap int) *lookupNodes {
-	return &lookupNodes{
+func newClosestNodes(id *ID, k int) *closestNodes {
+	return &closestNodes{
 		id:    id,
-		nodes: make([]*Node, 0, cap),
+		k:     k,
+		nodes: make([]*Node, 0, k),
 	}
 }
 
-func (ln *lookupNodes) CopyFrom(e *list.Element) {
-	e.Value.(*Bucket).Map(func(n *Node) bool {
-		ln.nodes = append(ln.nodes, n)
-		return true
+func (cn *closestNodes) Push(n *Node) {
+	if len(cn.nodes) < cn.k {
+		heap.Push((*closestHeap)(cn), n)
+	} else if cn.k > 0 && cn.id.cmpDistance(n.id, cn.nodes[0].id) < 0 {
+		cn.nodes[0] = n
+		heap.Fix((*closestHeap)(cn), 0)
+	}
+}
+
+func (cn *closestNodes) Len() int {
+	return len(cn.nodes)
+}
+
+func (cn *closestNodes) Sorted() []*Node {
+	nodes := make([]*Node, len(cn.nodes))
+	copy(nodes, cn.nodes)
+	sort.Slice(nodes, func(i, j int) bool {
+		return cn.id.cmpDistance(nodes[i].id, nodes[j].id) < 0
 	})
+	return nodes
 }
 
-func (ln *lookupNodes) Len() int {
-	return len(ln.nodes)
+type closestHeap closestNodes
+
+func (h *closestHeap) Len() int {
+	return len(h.nodes)
 }
 
-func (ln *lookupNodes) Less(i, j int) bool {
-	for k := 0; k < IDLen; k++ {
-		n1 := ln.nodes[i].id[k] ^ ln.id[k]
-		n2 := ln.nodes[j].id[k] ^ ln.id[k]
-		if n1 < n2 {
-			return true
-		} else if n1 > n2 {
-			return false
-		}
-	}
-	return true
+func (h *closestHeap) Less(i, j int) bool {
+	return h.id.cmpDistance(h.nodes[i].id, h.nodes[j].id) > 0
 }
 
-func (ln *lookupNodes) Swap(i, j int) {
-	ln.nodes[i], ln.nodes[j] = ln.nodes[j], ln.nodes[i]
+func (h *closestHeap) Swap(i, j int) {
+	h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i]
 }
 
-// Map all buckets
-func (t *Table) Map(f func(b *Bucket) bool) {
-	t.handle(func(e *list.Element) bool {
-		return f(e.Value.(*Bucket))
-	})
+func (h *closestHeap) Push(x interface{}) {
+	h.nodes = append(h.nodes, x.(*Node))
+}
+
+func (h *closestHeap) Pop() interface{} {
+	n := h.nodes[len(h.nodes)-1]
+	h.nodes = h.nodes[:len(h.nodes)-1]
+	return n
 }
 
-func (t *Table) handle(f func(e *list.Element) bool) {
-	for e := t.buckets.Front(); e != nil; e = e.Next() {
-		if f(e) == false {
+// Map all buckets
+func (t *Table) Map(f func(b *Bucket) bool) {
+	for _, b := range t.buckets {
+		if f(b) == false {
 			return
 		}
 	}
@@ -1,5 +1,134 @@
 package dht
 
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+func Test_Table_Lookup(t *testing.T) {
+	tb := NewTable(newRandomID(), 8)
+	var nodes []*Node
+	for i := 0; i < 2000; i++ {
+		if n, err := tb.Insert(newRandomID(), nil); err == nil {
+			n.Replied()
+			nodes = append(nodes, n)
+		}
+	}
+	if tb.NumNodes() != len(nodes) {
+		t.Fatal(tb.NumNodes(), len(nodes))
+	}
+	for _, n := range nodes {
+		if tb.Find(n.id).Find(n.id) != n {
+			t.Fatal(n)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		id := newRandomID()
+		sort.Slice(nodes, func(i, j int) bool {
+			return id.cmpDistance(nodes[i].id, nodes[j].id) < 0
+		})
+		ln := tb.Lookup(id)
+		if len(ln) != 8 {
+			t.Fatal(len(ln))
+		}
+		for j, n := range ln {
+			if n != nodes[j] {
+				t.Fatal(j, n, nodes[j])
+			}
+		}
+	}
+}
+
+func Test_Table_Capacity(t *testing.T) {
+	caps := []int{128, 64, 32, 16}
+	tb := NewTable(newRandomID(), 8, caps...)
+	for i := 0; i < 5000; i++ {
+		tb.Insert(newRandomID(), nil)
+	}
+	var depth int
+	tb.Map(func(b *Bucket) bool {
+		c := 8
+		if depth < len(caps) {
+			c = caps[depth]
+		}
+		if b.Capacity() != c || b.Count() > c {
+			t.Fatal(depth, b.Capacity(), b.Count())
+		}
+		depth++
+		return true
+	})
+	if n := tb.NumNodes(); n <= 128+64+32+16 {
+		t.Fatal(n)
+	}
+	if ln := tb.Lookup(newRandomID()); len(ln) != 8 {
+		t.Fatal(len(ln))
+	}
+}
+
+func Test_Table_Subnet(t *testing.T) {
+	addr := func(s string) *net.UDPAddr {
+		a, _ := net.ResolveUDPAddr("udp", s)
+		return a
+	}
+	tb := NewTable(newRandomID(), 8)
+	for i, limits := range [][3]int{{0, 3, 3}, {2, 0, 2}} {
+		tb = NewTable(newRandomID(), 8)
+		tb.SetSubnetLimits(limits[0], limits[1])
+		var n int
+		for j := 0; j < 100; j++ {
+			if _, err := tb.Insert(newRandomID(), addr(fmt.Sprintf("1.2.3.%d:6881", j))); err == nil {
+				n++
+			}
+		}
+		if n != limits[2] || tb.NumSubnet(net.ParseIP("1.2.3.4")) != n {
+			t.Fatal(i, n)
+		}
+	}
+	id := newRandomID()
+	if _, err := tb.Insert(id, addr("5.6.7.8:6881")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tb.Insert(id, addr("9.9.9.9:6881")); err == nil {
+		t.Fatal(id)
+	}
+	if _, err := tb.Insert(id, addr("5.6.7.8:6882")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Table_SetNodeLimits(t *testing.T) {
+	tb := NewTable(newRandomID(), 8)
+	n, _ := tb.Insert(newRandomID(), nil)
+	tb.SetNodeLimits(time.Minute, 1)
+	n.Replied()
+	if n.goodUntil().After(time.Now().Add(time.Minute)) {
+		t.Fatal(n.goodUntil())
+	}
+	if n.Fail(); n.State() != NodeBad || NewNode(n.id, nil).lim().maxFails != 3 {
+		t.Fatal(n.State())
+	}
+}
+
+func Test_diverse(t *testing.T) {
+	var nodes []*Node
+	for i := 0; i < 6; i++ {
+		a, _ := net.ResolveUDPAddr("udp", fmt.Sprintf("1.2.%d.1:6881", i%2))
+		nodes = append(nodes, NewNode(newRandomID(), a))
+	}
+	ns := diverse(nodes, 3)
+	if len(ns) != 3 || ns[0] != nodes[0] || ns[1] != nodes[1] || ns[2] != nodes[2] {
+		t.Fatal(ns)
+	}
+	nodes[1].addr = nodes[0].addr
+	ns = diverse(nodes, 3)
+	if len(ns) != 3 || ns[0] != nodes[0] || ns[1] != nodes[1] || ns[2] != nodes[3] {
+		t.Fatal(ns)
+	}
+}
+
 /*
 import (
 	"math/rand"
@@ -0,0 +1,83 @@
+package dht
+
+import (
+	"container/heap"
+	"time"
+)
+
+type timerItem struct {
+	key   interface{}
+	time  time.Time
+	index int
+}
+
+type timerHeap []*timerItem
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].time.Before(h[j].time) }
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	item := x.(*timerItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// timerQueue schedules keys by due time, so that only the due keys
+// are visited
+type timerQueue struct {
+	items timerHeap
+	index map[interface{}]*timerItem
+}
+
+func newTimerQueue() *timerQueue {
+	return &timerQueue{
+		index: make(map[interface{}]*timerItem),
+	}
+}
+
+func (q *timerQueue) Count() int {
+	return len(q.items)
+}
+
+// Schedule set due time of key
+func (q *timerQueue) Schedule(key interface{}, t time.Time) {
+	if item, ok := q.index[key]; ok {
+		item.time = t
+		heap.Fix(&q.items, item.index)
+		return
+	}
+	item := &timerItem{key: key, time: t}
+	q.index[key] = item
+	heap.Push(&q.items, item)
+}
+
+func (q *timerQueue) Remove(key interface{}) {
+	if item, ok := q.index[key]; ok {
+		delete(q.index, key)
+		heap.Remove(&q.items, item.index)
+	}
+}
+
+// Next remove and returns the earliest key due before now
+func (q *timerQueue) Next(now time.Time) (interface{}, bool) {
+	if len(q.items) == 0 || q.items[0].time.After(now) {
+		return nil, false
+	}
+	item := heap.Pop(&q.items).(*timerItem)
+	delete(q.index, item.key)
+	return item.key, true
+}
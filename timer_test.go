@@ -0,0 +1,30 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_timerQueue(t *testing.T) {
+	q := newTimerQueue()
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		q.Schedule(i, now.Add(time.Duration(10-i)*time.Second))
+	}
+	q.Schedule(0, now.Add(-time.Second))
+	q.Remove(9)
+	if q.Count() != 9 {
+		t.Fatal(q.Count())
+	}
+
+	var keys []int
+	for key, ok := q.Next(now.Add(3 * time.Second)); ok; key, ok = q.Next(now.Add(3 * time.Second)) {
+		keys = append(keys, key.(int))
+	}
+	if len(keys) != 3 || keys[0] != 0 || keys[1] != 8 || keys[2] != 7 {
+		t.Fatal(keys)
+	}
+	if q.Count() != 6 {
+		t.Fatal(q.Count())
+	}
+}
@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"container/list"
+	"net"
+	"time"
+)
+
+type transaction struct {
+	key  string
+	time time.Time
+}
+
+// transactions record when the queries were sent to measure rtt
+type transactions struct {
+	cap int
+	ts  map[string]*list.Element
+	// the least recently sent first
+	lru *list.List
+}
+
+func newTransactions(cap int) *transactions {
+	return &transactions{
+		cap: cap,
+		ts:  make(map[string]*list.Element),
+		lru: list.New(),
+	}
+}
+
+func (t *transactions) Count() int {
+	return t.lru.Len()
+}
+
+func (t *transactions) Insert(addr *net.UDPAddr, tid []byte) {
+	k := transactionKey(addr, tid)
+	if e, ok := t.ts[k]; ok {
+		e.Value.(*transaction).time = time.Now()
+		t.lru.MoveToBack(e)
+	} else if t.lru.Len() < t.cap {
+		t.ts[k] = t.lru.PushBack(&transaction{k, time.Now()})
+	}
+}
+
+// Remove returns the round trip time of a query
+func (t *transactions) Remove(addr *net.UDPAddr, tid []byte) (time.Duration, bool) {
+	k := transactionKey(addr, tid)
+	if e, ok := t.ts[k]; ok {
+		delete(t.ts, k)
+		t.lru.Remove(e)
+		return time.Since(e.Value.(*transaction).time), true
+	}
+	return 0, false
+}
+
+// Expire remove the queries sent before tm ago, only the expired
+// queries are visited
+func (t *transactions) Expire(tm time.Duration) {
+	for e := t.lru.Front(); e != nil; e = t.lru.Front() {
+		tr := e.Value.(*transaction)
+		if time.Since(tr.time) <= tm {
+			return
+		}
+		delete(t.ts, tr.key)
+		t.lru.Remove(e)
+	}
+}
+
+func transactionKey(addr *net.UDPAddr, tid []byte) string {
+	return addr.String() + string(tid)
+}
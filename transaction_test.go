@@ -0,0 +1,52 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_transactions(t *testing.T) {
+	ts := newTransactions(1)
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:6881")
+	tid := encodeTID("ping", 0)
+	ts.Insert(addr, tid)
+	ts.Insert(addr, encodeTID("find_node", 0))
+	if ts.Count() != 1 {
+		t.Fatal(ts.Count())
+	}
+	if _, ok := ts.Remove(addr, tid); !ok {
+		t.Fatal(addr)
+	}
+	if _, ok := ts.Remove(addr, tid); ok {
+		t.Fatal(addr)
+	}
+}
+
+func Test_transactions_Expire(t *testing.T) {
+	ts := newTransactions(8)
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:6881")
+	for i := 0; i < 4; i++ {
+		ts.Insert(addr, encodeTID("ping", int16(i)))
+	}
+	ts.lru.Front().Value.(*transaction).time = time.Now().Add(-time.Minute)
+	ts.Expire(time.Second)
+	if ts.Count() != 3 || len(ts.ts) != 3 {
+		t.Fatal(ts.Count())
+	}
+	if _, ok := ts.Remove(addr, encodeTID("ping", 0)); ok {
+		t.Fatal("expired")
+	}
+	// a resent query is the most recently sent
+	ts.Insert(addr, encodeTID("ping", 1))
+	for e := ts.lru.Front(); e != nil; e = e.Next() {
+		e.Value.(*transaction).time = time.Now().Add(-time.Minute)
+	}
+	ts.lru.Back().Value.(*transaction).time = time.Now()
+	if ts.Expire(time.Second); ts.Count() != 1 {
+		t.Fatal(ts.Count())
+	}
+	if _, ok := ts.Remove(addr, encodeTID("ping", 1)); !ok {
+		t.Fatal("resent")
+	}
+}